@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// A hit is a successful redirection of a short URL.
+type hit struct {
+	Time    time.Time
+	Name    string
+	Referer string
+	User    string
+}
+
+// An analyticsSink receives the hits of the short URLs.
+type analyticsSink interface {
+	// Record records a hit. It is called on the redirect path so it must
+	// return quickly and never block.
+	Record(h hit)
+}
+
+// statsDayFormat is the format of the days used as keys in linkStats.Daily.
+const statsDayFormat = "2006-01-02"
+
+// linkStats are the aggregated hits of a short URL.
+type linkStats struct {
+	Name string `json:"name" bson:"_id"`
+	// Hits is the total number of hits.
+	Hits int `json:"hits" bson:"hits"`
+	// LastUsed is the time of the last hit, nil if never used.
+	LastUsed *time.Time `json:"lastUsed,omitempty" bson:"lastUsed,omitempty"`
+	// Daily is the number of hits per UTC day, keyed by statsDayFormat.
+	Daily map[string]int `json:"daily,omitempty" bson:"daily,omitempty"`
+}
+
+// A statsStore persists the aggregated hits of short URLs.
+type statsStore interface {
+	// AddHits adds hits to a short URL on a given day (see statsDayFormat) and
+	// updates its last use if lastUsed is more recent.
+	AddHits(ctx context.Context, name string, day string, count int, lastUsed time.Time) error
+
+	// LoadStats loads the stats of some short URLs keyed by name. Short URLs
+	// that were never used are missing from the result.
+	LoadStats(ctx context.Context, names []string) (map[string]linkStats, error)
+}
+
+// dailyHits identifies a group of hits to aggregate before saving them.
+type dailyHits struct {
+	name string
+	day  string
+}
+
+// An asyncAnalytics is an analyticsSink that aggregates hits in memory and
+// saves them in a statsStore in the background. Hits are dropped if they
+// arrive faster than they can be aggregated.
+type asyncAnalytics struct {
+	store statsStore
+	hits  chan hit
+	done  chan struct{}
+
+	// mu protects dropped and closed, and makes sure that no hit is sent
+	// once hits is closed.
+	mu      sync.Mutex
+	dropped int
+	closed  bool
+}
+
+// newAsyncAnalytics creates an asyncAnalytics and starts saving the hits it
+// receives every flushInterval. Up to bufferSize hits can wait to be
+// aggregated.
+func newAsyncAnalytics(store statsStore, bufferSize int, flushInterval time.Duration) *asyncAnalytics {
+	a := &asyncAnalytics{
+		store: store,
+		hits:  make(chan hit, bufferSize),
+		done:  make(chan struct{}),
+	}
+	go a.run(flushInterval)
+	return a
+}
+
+// Record queues a hit, or drops it if the queue is full or if the analytics
+// are closed.
+func (a *asyncAnalytics) Record(h hit) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		a.dropped++
+		return
+	}
+	select {
+	case a.hits <- h:
+	default:
+		a.dropped++
+	}
+}
+
+// Dropped returns the number of hits that were dropped so far.
+func (a *asyncAnalytics) Dropped() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.dropped
+}
+
+// Close stops receiving hits and saves the pending ones. Hits recorded after
+// Close, e.g. by requests still running after a shutdown timeout, are dropped.
+func (a *asyncAnalytics) Close() {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.hits)
+	}
+	a.mu.Unlock()
+	<-a.done
+}
+
+func (a *asyncAnalytics) run(flushInterval time.Duration) {
+	defer close(a.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	counts := map[dailyHits]int{}
+	lastUsed := map[dailyHits]time.Time{}
+	flush := func() {
+		for key, count := range counts {
+			if err := a.store.AddHits(context.Background(), key.name, key.day, count, lastUsed[key]); err != nil {
+				log.Printf("Could not save %d hits of %q: %v", count, key.name, err)
+			}
+		}
+		counts = map[dailyHits]int{}
+		lastUsed = map[dailyHits]time.Time{}
+	}
+
+	for {
+		select {
+		case h, ok := <-a.hits:
+			if !ok {
+				flush()
+				return
+			}
+			key := dailyHits{h.Name, h.Time.UTC().Format(statsDayFormat)}
+			counts[key]++
+			if h.Time.After(lastUsed[key]) {
+				lastUsed[key] = h.Time
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
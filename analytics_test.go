@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAsyncAnalytics(t *testing.T) {
+	store := &memoryDatabase{}
+	a := newAsyncAnalytics(store, 10, time.Hour)
+
+	first := time.Date(2020, 9, 3, 23, 0, 0, 0, time.UTC)
+	// In UTC, this is on the same day as first.
+	second := time.Date(2020, 9, 4, 0, 30, 0, 0, time.FixedZone("CET", 3600))
+	third := time.Date(2020, 9, 4, 12, 0, 0, 0, time.UTC)
+	a.Record(hit{Time: first, Name: "wiki"})
+	a.Record(hit{Time: second, Name: "wiki", Referer: "http://example.com"})
+	a.Record(hit{Time: third, Name: "wiki", User: "lascap"})
+	a.Record(hit{Time: third, Name: "google"})
+	a.Close()
+
+	stats, err := store.LoadStats(context.Background(), []string{"wiki", "google"})
+	if err != nil {
+		t.Fatalf("LoadStats failed: %v", err)
+	}
+	if got, want := stats["wiki"].Hits, 3; got != want {
+		t.Errorf("wiki has %d hits, want %d", got, want)
+	}
+	if got, want := stats["wiki"].Daily, map[string]int{"2020-09-03": 2, "2020-09-04": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("wiki has daily hits %v, want %v", got, want)
+	}
+	if got := stats["wiki"].LastUsed; got == nil || !got.Equal(third) {
+		t.Errorf("wiki was last used at %v, want %v", got, third)
+	}
+	if got, want := stats["google"].Hits, 1; got != want {
+		t.Errorf("google has %d hits, want %d", got, want)
+	}
+	if got := a.Dropped(); got != 0 {
+		t.Errorf("%d hits were dropped", got)
+	}
+
+	// A request still running after the shutdown timeout.
+	a.Record(hit{Time: third, Name: "wiki"})
+	if got, want := a.Dropped(), 1; got != want {
+		t.Errorf("%d hits were dropped after a hit recorded once closed, want %d", got, want)
+	}
+}
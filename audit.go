@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An auditEntry records a change made to a short URL, with enough details to
+// find out later who did what and from where.
+type auditEntry struct {
+	// Time is when the change was made.
+	Time time.Time `json:"time" bson:"time"`
+	// User who made the change, empty if unknown.
+	User string `json:"user,omitempty" bson:"user,omitempty"`
+	// SourceIP is the IP address of the client who made the change.
+	SourceIP string `json:"sourceIp,omitempty" bson:"sourceIp,omitempty"`
+	// Action is the kind of change, see revision.Action.
+	Action string `json:"action" bson:"action"`
+	// Name is the short name of the URL that was changed.
+	Name string `json:"name" bson:"name"`
+	// Before is the URL before the change, nil if it did not exist.
+	Before *namedURL `json:"before,omitempty" bson:"before,omitempty"`
+	// After is the URL after the change, nil if it was deleted.
+	After *namedURL `json:"after,omitempty" bson:"after,omitempty"`
+}
+
+// An auditSink keeps the audit trail. Entries are only ever appended.
+type auditSink interface {
+	RecordAudit(ctx context.Context, entry auditEntry) error
+}
+
+// An auditStore is an auditSink that can also be queried.
+type auditStore interface {
+	auditSink
+
+	// ListAudit lists the entries matching the query, most recent first.
+	ListAudit(ctx context.Context, q auditQuery) ([]auditEntry, error)
+}
+
+// maxListedAudit is the maximum number of entries returned by ListAudit.
+const maxListedAudit = 1000
+
+// An auditQuery selects audit entries. Empty fields are not filtered on.
+type auditQuery struct {
+	User   string
+	Name   string
+	Action string
+	// Since only keeps the entries made at or after it if set.
+	Since time.Time
+	// Until only keeps the entries made strictly before it if set.
+	Until time.Time
+	// Limit is the maximum number of entries to return. If zero or above
+	// maxListedAudit, maxListedAudit is used instead.
+	Limit int
+}
+
+// limit returns the actual maximum number of entries to return for this query.
+func (q auditQuery) limit() int {
+	if q.Limit <= 0 || q.Limit > maxListedAudit {
+		return maxListedAudit
+	}
+	return q.Limit
+}
+
+// matches returns whether an entry is selected by the query, regardless of
+// the limit.
+func (q auditQuery) matches(entry auditEntry) bool {
+	if q.User != "" && entry.User != q.User {
+		return false
+	}
+	if q.Name != "" && entry.Name != q.Name {
+		return false
+	}
+	if q.Action != "" && entry.Action != q.Action {
+		return false
+	}
+	if !q.Since.IsZero() && entry.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !entry.Time.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// A fileAudit appends the audit entries to a file, one JSON object per line.
+type fileAudit struct {
+	path string
+
+	mu sync.Mutex
+}
+
+func (a *fileAudit) RecordAudit(ctx context.Context, entry auditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ListAudit reads the whole file to find the matching entries.
+func (a *fileAudit) ListAudit(ctx context.Context, q auditQuery) ([]auditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.Open(a.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []auditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("Could not parse the audit file %q: %w", a.path, err)
+		}
+		if q.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return latestAudit(entries, q.limit()), nil
+}
+
+// latestAudit returns up to limit entries, most recent first, from entries
+// sorted from the oldest.
+func latestAudit(entries []auditEntry, limit int) []auditEntry {
+	result := []auditEntry{}
+	for i := len(entries) - 1; i >= 0 && len(result) < limit; i-- {
+		result = append(result, entries[i])
+	}
+	return result
+}
+
+type clientIPKey struct{}
+
+// withClientIP returns a context carrying the IP of the client, as forwarded
+// by a trusted proxy.
+func withClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// clientIP returns the IP of the client who made the request: the one
+// forwarded by a trusted proxy if any, or else the remote address.
+func clientIP(request *http.Request) string {
+	if ip, ok := request.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// audit records a change in the audit trail. Failures are only logged: the
+// change was already made.
+func (s server) audit(request *http.Request, name string, user string, action string, before *namedURL, after *namedURL) {
+	if s.Audit == nil {
+		return
+	}
+	entry := auditEntry{
+		Time:     s.Clock.Now(),
+		User:     user,
+		SourceIP: clientIP(request),
+		Action:   action,
+		Name:     name,
+		Before:   before,
+		After:    after,
+	}
+	if err := s.Audit.RecordAudit(request.Context(), entry); err != nil {
+		log.Printf("Could not audit the %s of %q: %v", action, name, err)
+	}
+}
+
+// ListAudit lists the audit trail, most recent first, to super users only. The
+// entries are filtered with the query parameters "user", "name", "action",
+// "since" and "until" (RFC 3339 times) and "limit".
+func (s server) ListAudit(response http.ResponseWriter, request *http.Request) {
+	store, ok := s.Audit.(auditStore)
+	if !ok {
+		http.Error(response, `{"error":"The audit trail cannot be queried"}`, http.StatusNotFound)
+		return
+	}
+	user := userFrom(request)
+	if user == "" {
+		http.Error(response, `{"error":"Request with no user"}`, http.StatusUnauthorized)
+		return
+	}
+	if s.SuperUser == nil || !s.SuperUser[user] {
+		http.Error(response, `{"error":"Only super users can read the audit trail"}`, http.StatusForbidden)
+		return
+	}
+
+	params := request.URL.Query()
+	q := auditQuery{
+		User:   params.Get("user"),
+		Name:   params.Get("name"),
+		Action: params.Get("action"),
+	}
+	for param, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		value := params.Get(param)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			if jsonData, ok := marshalJson(response, map[string]string{"error": fmt.Sprintf("Invalid %s time: %q", param, value)}); ok {
+				http.Error(response, string(jsonData), http.StatusBadRequest)
+			}
+			return
+		}
+		*t = parsed
+	}
+	if limit := strings.TrimSpace(params.Get("limit")); limit != "" {
+		var err error
+		if q.Limit, err = strconv.Atoi(limit); err != nil {
+			if jsonData, ok := marshalJson(response, map[string]string{"error": fmt.Sprintf("Invalid limit: %q", limit)}); ok {
+				http.Error(response, string(jsonData), http.StatusBadRequest)
+			}
+			return
+		}
+	}
+
+	entries, err := store.ListAudit(request.Context(), q)
+	if err != nil {
+		writeDBError(response, err)
+		return
+	}
+	if len(entries) == 0 {
+		entries = []auditEntry{}
+	}
+
+	if jsonData, ok := marshalJson(response, map[string]interface{}{"entries": entries}); ok {
+		response.Write(jsonData)
+	}
+}
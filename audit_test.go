@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAuditStores(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testAuditStore(t, &memoryDatabase{})
+	})
+	t.Run("bolt", func(t *testing.T) {
+		db, err := newBoltDatabase(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatalf("newBoltDatabase failed: %v", err)
+		}
+		defer db.Close(context.Background())
+		testAuditStore(t, db)
+	})
+	t.Run("file", func(t *testing.T) {
+		testAuditStore(t, &fileAudit{path: filepath.Join(t.TempDir(), "audit.jsonl")})
+	})
+}
+
+func testAuditStore(t *testing.T, store auditStore) {
+	ctx := context.Background()
+
+	if entries, err := store.ListAudit(ctx, auditQuery{}); err != nil || len(entries) != 0 {
+		t.Errorf("ListAudit with no entries returned %v, %v", entries, err)
+	}
+
+	wiki := namedURL{Name: "wiki", URL: "http://en.wikipedia.org", Owners: []string{"lascap"}}
+	entries := []auditEntry{
+		{Time: time.Date(2020, 9, 3, 0, 0, 0, 0, time.UTC), User: "lascap", SourceIP: "10.0.0.1", Action: "save", Name: "wiki", After: &wiki},
+		{Time: time.Date(2020, 9, 4, 0, 0, 0, 0, time.UTC), User: "john", SourceIP: "10.0.0.2", Action: "save", Name: "google"},
+		{Time: time.Date(2020, 9, 5, 0, 0, 0, 0, time.UTC), User: "lascap", SourceIP: "10.0.0.1", Action: "delete", Name: "wiki", Before: &wiki},
+	}
+	for _, entry := range entries {
+		if err := store.RecordAudit(ctx, entry); err != nil {
+			t.Fatalf("RecordAudit failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		desc   string
+		query  auditQuery
+		expect []auditEntry
+	}{
+		{
+			desc:   "All",
+			expect: []auditEntry{entries[2], entries[1], entries[0]},
+		},
+		{
+			desc:   "By user",
+			query:  auditQuery{User: "lascap"},
+			expect: []auditEntry{entries[2], entries[0]},
+		},
+		{
+			desc:   "By name and action",
+			query:  auditQuery{Name: "wiki", Action: "save"},
+			expect: []auditEntry{entries[0]},
+		},
+		{
+			desc:   "By time",
+			query:  auditQuery{Since: entries[1].Time, Until: entries[2].Time},
+			expect: []auditEntry{entries[1]},
+		},
+		{
+			desc:   "Limited",
+			query:  auditQuery{Limit: 1},
+			expect: []auditEntry{entries[2]},
+		},
+	}
+	for _, test := range tests {
+		got, err := store.ListAudit(ctx, test.query)
+		if err != nil {
+			t.Errorf("%s: ListAudit failed: %v", test.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("%s: ListAudit returned\n%#v\nwant\n%#v", test.desc, got, test.expect)
+		}
+	}
+}
+
+func TestAuditTrail(t *testing.T) {
+	db := &memoryDatabase{}
+	s := &server{
+		DB:        db,
+		Clock:     fakeClock{time.Date(2020, 9, 3, 10, 0, 0, 0, time.UTC)},
+		SuperUser: map[string]bool{"SUPER USER": true},
+		Audit:     db,
+	}
+	// Requests made with httptest come from 192.0.2.1.
+	proxy, err := newTrustedProxy([]string{"192.0.2.0/24"}, "", "")
+	if err != nil {
+		t.Fatalf("newTrustedProxy failed: %v", err)
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/_/audit", s.ListAudit).Methods("GET")
+	r.HandleFunc("/_/save", s.Save).Methods("POST")
+	r.HandleFunc("/_/{name}", s.Update).Methods("PUT")
+	r.HandleFunc("/_/{name}", s.Delete).Methods("DELETE")
+	handler := proxy.middleware(r)
+
+	// The proxy forwards the user and the IPs of the client.
+	forwarded := func(user string) map[string]string {
+		return map[string]string{
+			"X-Forwarded-For":  "1.2.3.4, 192.168.1.7",
+			"X-Forwarded-User": user,
+		}
+	}
+
+	serveRequest(handler, "POST", "/_/save", `{"name":"wiki","url":"http://en.wikipedia.org"}`, forwarded("lascap"))
+	serveRequest(handler, "PUT", "/_/wiki", `{"url":"http://fr.wikipedia.org"}`, forwarded("lascap"))
+	serveRequest(handler, "DELETE", "/_/wiki", "", forwarded("lascap"))
+
+	if response := serveRequest(handler, "GET", "/_/audit", "", forwarded("lascap")); response.Code != http.StatusForbidden {
+		t.Errorf("Reading the audit trail as a normal user had response code %d, want %d", response.Code, http.StatusForbidden)
+	}
+	if response := serveRequest(handler, "GET", "/_/audit?since=yesterday", "", forwarded("SUPER USER")); response.Code != http.StatusBadRequest {
+		t.Errorf("Reading the audit trail with an invalid time had response code %d, want %d", response.Code, http.StatusBadRequest)
+	}
+
+	response := serveRequest(handler, "GET", "/_/audit?name=wiki&user=lascap&limit=2", "", forwarded("SUPER USER"))
+	if response.Code != http.StatusOK {
+		t.Fatalf("Reading the audit trail had response code %d, want %d\n%v", response.Code, http.StatusOK, response)
+	}
+	var got struct {
+		Entries []auditEntry `json:"entries"`
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Reading the audit trail returned %q: %v", response.Body.String(), err)
+	}
+	if len(got.Entries) != 2 {
+		t.Fatalf("Reading the audit trail returned %d entries, want 2:\n%#v", len(got.Entries), got.Entries)
+	}
+	deleted, updated := got.Entries[0], got.Entries[1]
+	if deleted.Action != "delete" || deleted.Before == nil || deleted.Before.URL != "http://fr.wikipedia.org" || deleted.After != nil {
+		t.Errorf("The last audit entry is %#v, want the deletion", deleted)
+	}
+	if updated.Action != "update" || updated.Before == nil || updated.Before.URL != "http://en.wikipedia.org" || updated.After == nil || updated.After.URL != "http://fr.wikipedia.org" {
+		t.Errorf("The previous audit entry is %#v, want the update", updated)
+	}
+	if deleted.SourceIP != "192.168.1.7" {
+		t.Errorf("The audit entry has the source IP %q, want the one added by the proxy", deleted.SourceIP)
+	}
+}
+
+func TestAuditTrailMatchesStoredURLs(t *testing.T) {
+	db := &memoryDatabase{}
+	s := &server{
+		DB:                db,
+		Clock:             fakeClock{time.Date(2020, 9, 3, 10, 0, 0, 0, time.UTC)},
+		SuperUser:         map[string]bool{"SUPER USER": true},
+		AnonymousLinks:    anonymousExpire,
+		AnonymousLinksTTL: 24 * time.Hour,
+		Audit:             db,
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/_/save", s.Save).Methods("POST")
+	r.HandleFunc("/_/{name}/claim", s.Claim).Methods("POST")
+	r.HandleFunc("/_/{name}", s.Update).Methods("PUT")
+
+	serveAs(r, "POST", "/_/save", `{"name":"wiki","url":"http://en.wikipedia.org"}`, "")
+	// The client cannot change the expiry with an update.
+	serveAs(r, "PUT", "/_/wiki", `{"url":"http://fr.wikipedia.org","expiresAt":"2030-01-01T00:00:00Z"}`, "SUPER USER")
+	updated, err := db.LoadURL(context.Background(), "wiki")
+	if err != nil {
+		t.Fatalf("LoadURL failed: %v", err)
+	}
+	serveAs(r, "POST", "/_/wiki/claim", "", "SUPER USER")
+	claimed, err := db.LoadURL(context.Background(), "wiki")
+	if err != nil {
+		t.Fatalf("LoadURL failed: %v", err)
+	}
+
+	entries, err := db.ListAudit(context.Background(), auditQuery{Name: "wiki"})
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("ListAudit returned %#v, %v, want 3 entries", entries, err)
+	}
+	for i, want := range []namedURL{claimed, updated} {
+		if got := entries[i].After; got == nil || !reflect.DeepEqual(*got, want) {
+			t.Errorf("The %s audit entry recorded %#v, want the stored URL %#v", entries[i].Action, got, want)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gorilla/securecookie"
+	"golang.org/x/oauth2"
+
+	neturl "net/url"
+)
+
+const (
+	// sessionCookieName is the name of the cookie keeping the logged in user.
+	sessionCookieName = "url-shortener-session"
+	// loginCookieName is the name of the cookie keeping the state of a login
+	// while the user is on the identity provider.
+	loginCookieName = "url-shortener-login"
+	// loginTimeout is the maximum time to log in on the identity provider.
+	loginTimeout = 10 * time.Minute
+)
+
+// oidcConfig configures the login with an OpenID Connect provider.
+type oidcConfig struct {
+	// IssuerURL is the URL of the identity provider, e.g.
+	// https://accounts.google.com.
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the absolute URL of the callback page of the shortener,
+	// as registered on the identity provider, e.g.
+	// https://go.example.com/_/oauth2/callback.
+	RedirectURL string
+	// AllowedDomains are the email domains of the users allowed to log in. If
+	// empty, any user with a verified email can log in.
+	AllowedDomains []string
+	// SessionSecret is the key used to sign the session cookies. It must be
+	// at least 32 bytes long.
+	SessionSecret []byte
+	// SessionTTL is how long users stay logged in.
+	SessionTTL time.Duration
+}
+
+// An oidcAuth logs users in with the authorization code flow of an OpenID
+// Connect provider and keeps them logged in with a signed session cookie.
+type oidcAuth struct {
+	config         oauth2.Config
+	verifier       *oidc.IDTokenVerifier
+	cookies        *securecookie.SecureCookie
+	allowedDomains map[string]bool
+	sessionTTL     time.Duration
+	// secureCookies is whether the cookies are only sent over HTTPS. It
+	// follows the scheme of the redirect URL rather than the request, as TLS
+	// is often terminated by a proxy in front of the shortener.
+	secureCookies bool
+}
+
+// A session is the content of the session cookie.
+type session struct {
+	User    string
+	Expires time.Time
+}
+
+// A loginState is the content of the login cookie.
+type loginState struct {
+	State    string
+	Redirect string
+}
+
+// newOIDCAuth discovers the endpoints of the identity provider and creates an
+// oidcAuth.
+func newOIDCAuth(ctx context.Context, config oidcConfig) (*oidcAuth, error) {
+	if len(config.SessionSecret) < 32 {
+		return nil, fmt.Errorf("The session secret must be at least 32 bytes long")
+	}
+	provider, err := oidc.NewProvider(ctx, config.IssuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("Could not discover the OpenID Connect provider %q: %w", config.IssuerURL, err)
+	}
+	a := &oidcAuth{
+		config: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  config.RedirectURL,
+			Scopes:       []string{oidc.ScopeOpenID, "email"},
+		},
+		verifier:      provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+		cookies:       securecookie.New(config.SessionSecret, nil),
+		sessionTTL:    config.SessionTTL,
+		secureCookies: strings.HasPrefix(strings.ToLower(config.RedirectURL), "https://"),
+	}
+	a.cookies.MaxAge(int(config.SessionTTL.Seconds()))
+	if len(config.AllowedDomains) > 0 {
+		a.allowedDomains = map[string]bool{}
+		for _, domain := range config.AllowedDomains {
+			a.allowedDomains[strings.ToLower(domain)] = true
+		}
+	}
+	return a, nil
+}
+
+// Login redirects to the identity provider. Once logged in, the user is sent
+// back to the page given in the "redirect" query parameter.
+func (a *oidcAuth) Login(response http.ResponseWriter, request *http.Request) {
+	stateBytes := make([]byte, 16)
+	if _, err := rand.Read(stateBytes); err != nil {
+		http.Error(response, `{"error":"Could not start login"}`, http.StatusInternalServerError)
+		return
+	}
+	state := loginState{
+		State:    base64.RawURLEncoding.EncodeToString(stateBytes),
+		Redirect: localRedirect(request.URL.Query().Get("redirect")),
+	}
+	encoded, err := a.cookies.Encode(loginCookieName, state)
+	if err != nil {
+		http.Error(response, `{"error":"Could not start login"}`, http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(response, &http.Cookie{
+		Name:     loginCookieName,
+		Value:    encoded,
+		Path:     "/",
+		Expires:  time.Now().Add(loginTimeout),
+		HttpOnly: true,
+		Secure:   a.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(response, request, a.config.AuthCodeURL(state.State), http.StatusFound)
+}
+
+// Callback is where the identity provider sends the user back after login. It
+// checks the identity of the user and starts a session.
+func (a *oidcAuth) Callback(response http.ResponseWriter, request *http.Request) {
+	var state loginState
+	cookie, err := request.Cookie(loginCookieName)
+	if err != nil || a.cookies.Decode(loginCookieName, cookie.Value, &state) != nil ||
+		state.State != request.URL.Query().Get("state") {
+		http.Error(response, `{"error":"Invalid login state, please retry"}`, http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(response, &http.Cookie{Name: loginCookieName, Path: "/", MaxAge: -1})
+
+	if errCode := request.URL.Query().Get("error"); errCode != "" {
+		if jsonData, ok := marshalJson(response, map[string]string{"error": fmt.Sprintf("Login failed: %s", errCode)}); ok {
+			http.Error(response, string(jsonData), http.StatusUnauthorized)
+		}
+		return
+	}
+
+	token, err := a.config.Exchange(request.Context(), request.URL.Query().Get("code"))
+	if err != nil {
+		log.Printf("Could not exchange the login code: %v", err)
+		http.Error(response, `{"error":"Could not log in"}`, http.StatusUnauthorized)
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		http.Error(response, `{"error":"The identity provider did not return an ID token"}`, http.StatusUnauthorized)
+		return
+	}
+	idToken, err := a.verifier.Verify(request.Context(), rawIDToken)
+	if err != nil {
+		log.Printf("Invalid ID token: %v", err)
+		http.Error(response, `{"error":"Could not log in"}`, http.StatusUnauthorized)
+		return
+	}
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified *bool  `json:"email_verified"`
+	}
+	if err := idToken.Claims(&claims); err != nil || claims.Email == "" {
+		http.Error(response, `{"error":"The identity provider did not return an email"}`, http.StatusUnauthorized)
+		return
+	}
+	if claims.EmailVerified == nil || !*claims.EmailVerified {
+		http.Error(response, `{"error":"The email is not verified"}`, http.StatusForbidden)
+		return
+	}
+	if !a.isAllowed(claims.Email) {
+		if jsonData, ok := marshalJson(response, map[string]string{"error": fmt.Sprintf("%s is not allowed to log in", claims.Email)}); ok {
+			http.Error(response, string(jsonData), http.StatusForbidden)
+		}
+		return
+	}
+
+	expires := time.Now().Add(a.sessionTTL)
+	encoded, err := a.cookies.Encode(sessionCookieName, session{User: claims.Email, Expires: expires})
+	if err != nil {
+		http.Error(response, `{"error":"Could not start session"}`, http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(response, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    encoded,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   a.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(response, request, state.Redirect, http.StatusFound)
+}
+
+// Logout ends the session.
+func (a *oidcAuth) Logout(response http.ResponseWriter, request *http.Request) {
+	http.SetCookie(response, &http.Cookie{Name: sessionCookieName, Path: "/", MaxAge: -1})
+	http.Redirect(response, request, "/", http.StatusFound)
+}
+
+// isAllowed returns whether a user may log in given their email.
+func (a *oidcAuth) isAllowed(email string) bool {
+	if a.allowedDomains == nil {
+		return true
+	}
+	at := strings.LastIndex(email, "@")
+	return at >= 0 && a.allowedDomains[strings.ToLower(email[at+1:])]
+}
+
+// sessionUser returns the user logged in by the session cookie of a request,
+// or an empty string if there is none or it is invalid.
+func (a *oidcAuth) sessionUser(request *http.Request) string {
+	cookie, err := request.Cookie(sessionCookieName)
+	if err != nil {
+		return ""
+	}
+	var s session
+	if err := a.cookies.Decode(sessionCookieName, cookie.Value, &s); err != nil {
+		return ""
+	}
+	if time.Now().After(s.Expires) {
+		return ""
+	}
+	return s.User
+}
+
+// requireLogin wraps a handler so that it is only reached by logged in users,
+// or users already authenticated by an API token, except for the public
+// paths. The identity forwarded by a proxy is ignored: handlers get the user
+// from the session instead. Users that are not logged in are sent to the login
+// page, or get a 401 error for API calls.
+func (a *oidcAuth) requireLogin(next http.Handler, publicPaths ...string) http.Handler {
+	public := map[string]bool{}
+	for _, p := range publicPaths {
+		public[p] = true
+	}
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		request.Header.Del("X-Forwarded-User")
+		request.Header.Del(forwardedGroupsHeader)
+		if _, ok := request.Context().Value(userKey{}).(string); ok || public[request.URL.Path] {
+			next.ServeHTTP(response, request)
+			return
+		}
+
+		user := a.sessionUser(request)
+		if user == "" {
+			if request.Method != "GET" {
+				http.Error(response, `{"error":"Login required"}`, http.StatusUnauthorized)
+				return
+			}
+			http.Redirect(response, request, "/"+internalPagesPrefix+"/login?redirect="+
+				neturl.QueryEscape(request.URL.RequestURI()), http.StatusFound)
+			return
+		}
+		next.ServeHTTP(response, request.WithContext(withUser(request.Context(), user)))
+	})
+}
+
+// localRedirect returns the path to redirect to after login: only local paths
+// are accepted to avoid redirecting users to malicious sites.
+func localRedirect(redirect string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		return "/"
+	}
+	return redirect
+}
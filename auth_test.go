@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+)
+
+// A fakeIssuer is a minimal OpenID Connect provider: it logs in the user
+// given by email for the "good-code" authorization code.
+type fakeIssuer struct {
+	server        *httptest.Server
+	key           *rsa.PrivateKey
+	email         string
+	emailVerified bool
+	// noEmailVerified leaves the email_verified claim out of the ID tokens.
+	noEmailVerified bool
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	f := &fakeIssuer{key: key, emailVerified: true}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(response http.ResponseWriter, request *http.Request) {
+		json.NewEncoder(response).Encode(map[string]interface{}{
+			"issuer":                                f.server.URL,
+			"authorization_endpoint":                f.server.URL + "/authorize",
+			"token_endpoint":                        f.server.URL + "/token",
+			"jwks_uri":                              f.server.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(response http.ResponseWriter, request *http.Request) {
+		json.NewEncoder(response).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &f.key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/token", func(response http.ResponseWriter, request *http.Request) {
+		if request.FormValue("code") != "good-code" {
+			http.Error(response, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		response.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(response).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     f.idToken(t),
+		})
+	})
+	f.server = httptest.NewServer(mux)
+	return f
+}
+
+func (f *fakeIssuer) idToken(t *testing.T) string {
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key:       jose.JSONWebKey{Key: f.key, KeyID: "test"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("Could not create signer: %v", err)
+	}
+	values := map[string]interface{}{
+		"iss":            f.server.URL,
+		"sub":            f.email,
+		"aud":            "shortener",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"email":          f.email,
+		"email_verified": f.emailVerified,
+	}
+	if f.noEmailVerified {
+		delete(values, "email_verified")
+	}
+	claims, _ := json.Marshal(values)
+	signed, err := signer.Sign(claims)
+	if err != nil {
+		t.Fatalf("Could not sign token: %v", err)
+	}
+	token, err := signed.CompactSerialize()
+	if err != nil {
+		t.Fatalf("Could not serialize token: %v", err)
+	}
+	return token
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	defer issuer.server.Close()
+
+	auth, err := newOIDCAuth(context.Background(), oidcConfig{
+		IssuerURL:      issuer.server.URL,
+		ClientID:       "shortener",
+		ClientSecret:   "secret",
+		RedirectURL:    "http://go/_/oauth2/callback",
+		AllowedDomains: []string{"example.com"},
+		SessionSecret:  []byte(strings.Repeat("s", 32)),
+		SessionTTL:     time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("newOIDCAuth failed: %v", err)
+	}
+	r := http.NewServeMux()
+	r.HandleFunc("/_/login", auth.Login)
+	r.HandleFunc("/_/oauth2/callback", auth.Callback)
+	r.HandleFunc("/", func(response http.ResponseWriter, request *http.Request) {
+		response.Write([]byte(userFrom(request)))
+	})
+	handler := auth.requireLogin(r, "/_/login", "/_/oauth2/callback")
+
+	serve := func(method, target string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, nil)
+		request.Header.Set("X-Forwarded-User", "forged@example.com")
+		for _, cookie := range cookies {
+			request.AddCookie(cookie)
+		}
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response
+	}
+
+	tests := []struct {
+		desc            string
+		email           string
+		emailVerified   bool
+		noEmailVerified bool
+		code            string
+		expectCode      int
+	}{
+		{
+			desc:          "Allowed user",
+			email:         "pascal@example.com",
+			emailVerified: true,
+			code:          "good-code",
+			expectCode:    http.StatusFound,
+		},
+		{
+			desc:          "Other domain",
+			email:         "pascal@evil.com",
+			emailVerified: true,
+			code:          "good-code",
+			expectCode:    http.StatusForbidden,
+		},
+		{
+			desc:          "Email not verified",
+			email:         "pascal@example.com",
+			emailVerified: false,
+			code:          "good-code",
+			expectCode:    http.StatusForbidden,
+		},
+		{
+			desc:            "Email verification unknown",
+			email:           "pascal@example.com",
+			noEmailVerified: true,
+			code:            "good-code",
+			expectCode:      http.StatusForbidden,
+		},
+		{
+			desc:          "Bad code",
+			email:         "pascal@example.com",
+			emailVerified: true,
+			code:          "bad-code",
+			expectCode:    http.StatusUnauthorized,
+		},
+	}
+
+	for _, test := range tests {
+		issuer.email = test.email
+		issuer.emailVerified = test.emailVerified
+		issuer.noEmailVerified = test.noEmailVerified
+
+		response := serve("GET", "/wiki", nil)
+		if got, want := response.Code, http.StatusFound; got != want {
+			t.Errorf("%s: anonymous request had response code %d, want %d", test.desc, got, want)
+			continue
+		}
+		if got, want := response.Header().Get("Location"), "/_/login?redirect=%2Fwiki"; got != want {
+			t.Errorf("%s: anonymous request redirected to %q, want %q", test.desc, got, want)
+			continue
+		}
+
+		response = serve("GET", "/_/login?redirect=%2Fwiki", nil)
+		location, err := url.Parse(response.Header().Get("Location"))
+		if err != nil || !strings.HasPrefix(location.String(), issuer.server.URL+"/authorize") {
+			t.Errorf("%s: login redirected to %q, want the issuer", test.desc, location)
+			continue
+		}
+		loginCookies := response.Result().Cookies()
+
+		response = serve("GET", "/_/oauth2/callback?code="+test.code+"&state="+location.Query().Get("state"), loginCookies)
+		if got, want := response.Code, test.expectCode; got != want {
+			body, _ := ioutil.ReadAll(response.Body)
+			t.Errorf("%s: callback had response code %d, want %d\n%s", test.desc, got, want, body)
+			continue
+		}
+		if test.expectCode != http.StatusFound {
+			continue
+		}
+		if got, want := response.Header().Get("Location"), "/wiki"; got != want {
+			t.Errorf("%s: callback redirected to %q, want %q", test.desc, got, want)
+		}
+
+		response = serve("GET", "/wiki", response.Result().Cookies())
+		if got, want := response.Body.String(), test.email; got != want {
+			t.Errorf("%s: logged in request was made by %q, want %q", test.desc, got, want)
+		}
+	}
+}
+
+func TestOIDCLoginBadState(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	defer issuer.server.Close()
+
+	auth, err := newOIDCAuth(context.Background(), oidcConfig{
+		IssuerURL:     issuer.server.URL,
+		ClientID:      "shortener",
+		RedirectURL:   "http://go/_/oauth2/callback",
+		SessionSecret: []byte(strings.Repeat("s", 32)),
+		SessionTTL:    time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("newOIDCAuth failed: %v", err)
+	}
+
+	login := httptest.NewRecorder()
+	auth.Login(login, httptest.NewRequest("GET", "/_/login", nil))
+
+	request := httptest.NewRequest("GET", "/_/oauth2/callback?code=good-code&state=forged", nil)
+	for _, cookie := range login.Result().Cookies() {
+		request.AddCookie(cookie)
+	}
+	response := httptest.NewRecorder()
+	auth.Callback(response, request)
+
+	if got, want := response.Code, http.StatusBadRequest; got != want {
+		t.Errorf("Callback with a forged state had response code %d, want %d", got, want)
+	}
+}
+
+func TestOIDCSecureCookies(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	defer issuer.server.Close()
+
+	auth, err := newOIDCAuth(context.Background(), oidcConfig{
+		IssuerURL:     issuer.server.URL,
+		ClientID:      "shortener",
+		RedirectURL:   "https://go.example.com/_/oauth2/callback",
+		SessionSecret: []byte(strings.Repeat("s", 32)),
+		SessionTTL:    time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("newOIDCAuth failed: %v", err)
+	}
+
+	// TLS is terminated by a proxy: the request reaches the shortener in HTTP.
+	login := httptest.NewRecorder()
+	auth.Login(login, httptest.NewRequest("GET", "http://go.example.com/_/login", nil))
+	cookies := login.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].Secure {
+		t.Errorf("Login set the cookies %v, want a secure cookie", cookies)
+	}
+}
+
+func TestLocalRedirect(t *testing.T) {
+	tests := []struct {
+		redirect string
+		expect   string
+	}{
+		{"/wiki", "/wiki"},
+		{"/wiki?q=1", "/wiki?q=1"},
+		{"", "/"},
+		{"http://evil.com", "/"},
+		{"//evil.com", "/"},
+		{"/\\evil.com", "/"},
+	}
+
+	for _, test := range tests {
+		if got := localRedirect(test.redirect); got != test.expect {
+			t.Errorf("localRedirect(%q) = %q, want %q", test.redirect, got, test.expect)
+		}
+	}
+}
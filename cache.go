@@ -0,0 +1,170 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// A cachedDatabase is a database decorator that keeps the most recently loaded
+// URLs in memory to save a round trip on redirects. Entries expire after a
+// TTL, and are dropped whenever the URL is changed through this decorator:
+// changes made by other processes are only seen once the entry expires.
+type cachedDatabase struct {
+	db    database
+	size  int
+	ttl   time.Duration
+	clock Clock
+
+	mu sync.Mutex
+	// entries are sorted from the most recently used.
+	entries *list.List
+	byName  map[string]*list.Element
+	// generation is increased by each change so that a load started before
+	// a change does not cache the stale URL.
+	generation int
+	hits       int
+	misses     int
+}
+
+type cacheEntry struct {
+	url     namedURL
+	expires time.Time
+}
+
+// newCachedDatabase creates a cachedDatabase keeping up to size URLs for ttl.
+func newCachedDatabase(db database, size int, ttl time.Duration) *cachedDatabase {
+	return &cachedDatabase{
+		db:      db,
+		size:    size,
+		ttl:     ttl,
+		clock:   realClock{},
+		entries: list.New(),
+		byName:  map[string]*list.Element{},
+	}
+}
+
+// Hits returns the number of URLs loaded from the cache so far.
+func (d *cachedDatabase) Hits() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.hits
+}
+
+// Misses returns the number of URLs that had to be loaded from the database so
+// far.
+func (d *cachedDatabase) Misses() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.misses
+}
+
+func (d *cachedDatabase) LoadURL(ctx context.Context, name string) (namedURL, error) {
+	d.mu.Lock()
+	if elem, ok := d.byName[name]; ok {
+		entry := elem.Value.(*cacheEntry)
+		if d.clock.Now().Before(entry.expires) {
+			d.entries.MoveToFront(elem)
+			d.hits++
+			d.mu.Unlock()
+			return copyNamedURL(entry.url), nil
+		}
+		d.remove(name)
+	}
+	d.misses++
+	generation := d.generation
+	d.mu.Unlock()
+
+	u, err := d.db.LoadURL(ctx, name)
+	if err != nil {
+		return u, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if generation == d.generation {
+		d.add(copyNamedURL(u))
+	}
+	return u, nil
+}
+
+// add caches a URL, evicting the least recently used one if the cache is full.
+// The caller must hold mu.
+func (d *cachedDatabase) add(u namedURL) {
+	d.remove(u.Name)
+	d.byName[u.Name] = d.entries.PushFront(&cacheEntry{url: u, expires: d.clock.Now().Add(d.ttl)})
+	for d.entries.Len() > d.size {
+		d.remove(d.entries.Back().Value.(*cacheEntry).url.Name)
+	}
+}
+
+// remove drops a URL from the cache if it is there. The caller must hold mu.
+func (d *cachedDatabase) remove(name string) {
+	if elem, ok := d.byName[name]; ok {
+		d.entries.Remove(elem)
+		delete(d.byName, name)
+	}
+}
+
+// invalidate drops a URL that is being changed from the cache.
+func (d *cachedDatabase) invalidate(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.generation++
+	d.remove(name)
+}
+
+func (d *cachedDatabase) SaveURL(ctx context.Context, u namedURL) error {
+	defer d.invalidate(u.Name)
+	return d.db.SaveURL(ctx, u)
+}
+
+func (d *cachedDatabase) UpdateURL(ctx context.Context, u namedURL, principals []string) (namedURL, error) {
+	defer d.invalidate(u.Name)
+	return d.db.UpdateURL(ctx, u, principals)
+}
+
+func (d *cachedDatabase) DeleteURL(ctx context.Context, name string, principals []string) (namedURL, error) {
+	defer d.invalidate(name)
+	return d.db.DeleteURL(ctx, name, principals)
+}
+
+func (d *cachedDatabase) AddOwners(ctx context.Context, name string, owners []string, principals []string) (namedURL, error) {
+	defer d.invalidate(name)
+	return d.db.AddOwners(ctx, name, owners, principals)
+}
+
+func (d *cachedDatabase) RemoveOwners(ctx context.Context, name string, owners []string, principals []string) (namedURL, error) {
+	defer d.invalidate(name)
+	return d.db.RemoveOwners(ctx, name, owners, principals)
+}
+
+func (d *cachedDatabase) SetOwners(ctx context.Context, name string, owners []string, principals []string) (namedURL, error) {
+	defer d.invalidate(name)
+	return d.db.SetOwners(ctx, name, owners, principals)
+}
+
+func (d *cachedDatabase) ListURLs(ctx context.Context, q listQuery) ([]namedURL, string, error) {
+	return d.db.ListURLs(ctx, q)
+}
+
+func (d *cachedDatabase) SaveRevision(ctx context.Context, rev revision) error {
+	return d.db.SaveRevision(ctx, rev)
+}
+
+func (d *cachedDatabase) ListRevisions(ctx context.Context, name string) ([]revision, error) {
+	return d.db.ListRevisions(ctx, name)
+}
+
+func (d *cachedDatabase) SearchURLs(ctx context.Context, query string, limit int) ([]namedURL, error) {
+	return d.db.SearchURLs(ctx, query, limit)
+}
+
+func (d *cachedDatabase) Ping(ctx context.Context) error {
+	return d.db.Ping(ctx)
+}
+
+func (d *cachedDatabase) Close(ctx context.Context) error {
+	return d.db.Close(ctx)
+}
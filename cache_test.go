@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCachedDatabase(t *testing.T) {
+	ctx := context.Background()
+	db := &memoryDatabase{}
+	loads := map[string]int{}
+	stub := &stubDB{
+		loadURL: func(name string) (namedURL, error) {
+			loads[name]++
+			return db.LoadURL(ctx, name)
+		},
+		saveURL: func(name, url string, owners []string, shouldExpandDates bool) error {
+			return db.SaveURL(ctx, namedURL{Name: name, URL: url, Owners: owners})
+		},
+		updateURL: func(name, url string, shouldExpandDates bool, user string) error {
+			_, err := db.UpdateURL(ctx, namedURL{Name: name, URL: url}, nil)
+			return err
+		},
+		deleteURL: func(name, user string) error {
+			_, err := db.DeleteURL(ctx, name, nil)
+			return err
+		},
+	}
+	clock := &fakeClock{now: time.Date(2017, time.March, 14, 15, 9, 26, 0, time.UTC)}
+	cache := newCachedDatabase(stub, 2, time.Minute)
+	cache.clock = clock
+
+	for _, name := range []string{"wiki", "google", "mail", "maps"} {
+		if err := cache.SaveURL(ctx, namedURL{Name: name, URL: "http://" + name + ".example.com"}); err != nil {
+			t.Fatalf("SaveURL(%q) failed: %v", name, err)
+		}
+	}
+
+	load := func(name string) namedURL {
+		u, err := cache.LoadURL(ctx, name)
+		if err != nil {
+			t.Fatalf("LoadURL(%q) failed: %v", name, err)
+		}
+		return u
+	}
+
+	load("wiki")
+	load("wiki")
+	if loads["wiki"] != 1 {
+		t.Errorf("wiki was loaded %d times from the DB, want once", loads["wiki"])
+	}
+	if got, want := cache.Hits(), 1; got != want {
+		t.Errorf("Hits() = %d, want %d", got, want)
+	}
+	if got, want := cache.Misses(), 1; got != want {
+		t.Errorf("Misses() = %d, want %d", got, want)
+	}
+
+	// Modifying the URL must drop it from the cache.
+	if _, err := cache.UpdateURL(ctx, namedURL{Name: "wiki", URL: "http://new.example.com"}, nil); err != nil {
+		t.Fatalf("UpdateURL failed: %v", err)
+	}
+	if got, want := load("wiki").URL, "http://new.example.com"; got != want {
+		t.Errorf("LoadURL after an update returned %q, want %q", got, want)
+	}
+	if _, err := cache.DeleteURL(ctx, "wiki", nil); err != nil {
+		t.Fatalf("DeleteURL failed: %v", err)
+	}
+	if _, err := cache.LoadURL(ctx, "wiki"); err == nil {
+		t.Errorf("LoadURL after a delete should fail")
+	}
+
+	// Only the 2 most recently used URLs are kept.
+	loads = map[string]int{}
+	load("google")
+	load("mail")
+	load("google")
+	load("maps")
+	load("google")
+	load("mail")
+	if want := map[string]int{"google": 1, "mail": 2, "maps": 1}; !reflect.DeepEqual(loads, want) {
+		t.Errorf("Loads from the DB were %v, want %v", loads, want)
+	}
+	if got, want := len(cache.byName), 2; got != want {
+		t.Errorf("The cache has %d entries, want %d", got, want)
+	}
+
+	// Entries expire after the TTL.
+	clock.now = clock.now.Add(2 * time.Minute)
+	load("mail")
+	if loads["mail"] != 3 {
+		t.Errorf("mail was loaded %d times from the DB, want 3 times after it expired", loads["mail"])
+	}
+}
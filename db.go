@@ -2,11 +2,20 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
+	bolt "go.etcd.io/bbolt"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+
+	neturl "net/url"
 )
 
 // A namedURL is a URL associated with its short name.
@@ -16,25 +25,216 @@ type namedURL struct {
 	// URL is the long URL that is shortened. It must be a valid URL.
 	URL string `json:"url" bson:"url"`
 	// Email of users that are allowed to modify this association.
-	Owners []string `json:"owners" bson: "owners"`
+	Owners []string `json:"owners" bson:"owners"`
 	// Whether we should expand dates in the URL before redirecting.
 	// See https://golang.org/pkg/time/#Time.Format
 	ShouldExpandDates bool `json:"shouldExpandDates" bson:"shouldExpandDates"`
+	// Description is a free text explaining what the URL is about.
+	Description string `json:"description,omitempty" bson:"description,omitempty"`
+	// ExpiresAt is when the URL stops working, nil if it never expires. Only
+	// links created without an owner expire, until someone claims them.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+	// Visibility is who can see the URL: "public" (or empty), "unlisted" or
+	// "private".
+	Visibility string `json:"visibility,omitempty" bson:"visibility,omitempty"`
+	// Allowed are the users and groups, besides the owners, who may follow
+	// the URL if it is private.
+	Allowed []string `json:"allowed,omitempty" bson:"allowed,omitempty"`
+	// Kind is empty for plain redirects, or "template" if URL has
+	// placeholders to fill with the path following the short name.
+	Kind string `json:"kind,omitempty" bson:"kind,omitempty"`
+	// FallbackURL is where templates redirect when arguments are missing.
+	FallbackURL string `json:"fallbackUrl,omitempty" bson:"fallbackUrl,omitempty"`
+}
+
+// isExpired returns whether the URL has expired at the given time.
+func isExpired(u namedURL, now time.Time) bool {
+	return u.ExpiresAt != nil && !now.Before(*u.ExpiresAt)
+}
+
+// isOwner returns whether the user is one of the owners of the URL.
+func isOwner(u namedURL, user string) bool {
+	for _, owner := range u.Owners {
+		if owner == user {
+			return true
+		}
+	}
+	return false
+}
+
+// addOwners returns the owners with the added ones appended, skipping the ones
+// that are already there.
+func addOwners(owners []string, added []string) []string {
+	result := append([]string{}, owners...)
+	for _, owner := range added {
+		if !isOwner(namedURL{Owners: result}, owner) {
+			result = append(result, owner)
+		}
+	}
+	return result
+}
+
+// removeOwners returns the owners without the removed ones.
+func removeOwners(owners []string, removed []string) []string {
+	result := []string{}
+	for _, owner := range owners {
+		if !isOwner(namedURL{Owners: removed}, owner) {
+			result = append(result, owner)
+		}
+	}
+	return result
+}
+
+// removeLastOwners returns the owners of a URL without the removed ones, or an
+// error if none would be left.
+func removeLastOwners(u namedURL, removed []string) ([]string, error) {
+	owners := removeOwners(u.Owners, removed)
+	if len(owners) == 0 {
+		return nil, fmt.Errorf("Cannot remove all the owners of %#v", u.Name)
+	}
+	return owners, nil
+}
+
+// groupPrefix is the prefix of the owners that are groups of users rather
+// than single users, e.g. "group:platform".
+const groupPrefix = "group:"
+
+// isOwnedBy returns whether one of the principals, i.e. a user and the groups
+// they belong to, is an owner of the URL. A nil list of principals is
+// considered as owner of every URL.
+func isOwnedBy(u namedURL, principals []string) bool {
+	if principals == nil {
+		return true
+	}
+	for _, principal := range principals {
+		if isOwner(u, principal) {
+			return true
+		}
+	}
+	return false
+}
+
+// A revision records a change made to a short URL.
+type revision struct {
+	// Name is the short name of the URL that was changed.
+	Name string `json:"name" bson:"name"`
+	// User who made the change, empty if unknown.
+	User string `json:"user,omitempty" bson:"user,omitempty"`
+	// Time is when the change was made.
+	Time time.Time `json:"time" bson:"time"`
+	// Action is the kind of change: "save", "update", "delete", "revert" or
+	// "owners".
+	Action string `json:"action" bson:"action"`
+	// Before is the URL before the change, nil if it did not exist.
+	Before *namedURL `json:"before,omitempty" bson:"before,omitempty"`
+	// After is the URL after the change, nil if it was deleted.
+	After *namedURL `json:"after,omitempty" bson:"after,omitempty"`
+}
+
+// maxListedURLs is the maximum number of URLs returned by ListURLs.
+const maxListedURLs = 5000
+
+// A listQuery selects a page of URLs to list.
+type listQuery struct {
+	// After is a cursor to continue listing: only names strictly after it are
+	// returned.
+	After string
+	// Limit is the maximum number of URLs to return. If zero or above
+	// maxListedURLs, maxListedURLs is used instead.
+	Limit int
+	// Owner only keeps the URLs owned by this user if set.
+	Owner string
+	// NamePrefix only keeps the URLs whose name starts with it if set.
+	NamePrefix string
+	// Domain only keeps the URLs whose target host contains it if set.
+	Domain string
+}
+
+// limit returns the actual maximum number of URLs to return for this query.
+func (q listQuery) limit() int {
+	if q.Limit <= 0 || q.Limit > maxListedURLs {
+		return maxListedURLs
+	}
+	return q.Limit
+}
+
+// matches returns whether a URL passes the filters of the query, without
+// taking the cursor into account.
+func (q listQuery) matches(u namedURL) bool {
+	if q.Owner != "" && !isOwner(u, q.Owner) {
+		return false
+	}
+	if !strings.HasPrefix(u.Name, q.NamePrefix) {
+		return false
+	}
+	if q.Domain != "" {
+		parsed, err := neturl.Parse(u.URL)
+		if err != nil || !strings.Contains(strings.ToLower(parsed.Host), strings.ToLower(q.Domain)) {
+			return false
+		}
+	}
+	return true
 }
 
 type database interface {
-	// ListURLs list all URLs that were saved or at least the 5000 first ones.
-	ListURLs(ctx context.Context) ([]namedURL, error)
+	// ListURLs lists a page of URLs that were saved, sorted by name. It also
+	// returns the cursor to use as listQuery.After to get the next page, or an
+	// empty string if this is the last page.
+	ListURLs(ctx context.Context, q listQuery) (urls []namedURL, next string, err error)
 
 	// LoadURL loads a URL that was saved previously.
 	LoadURL(ctx context.Context, name string) (namedURL, error)
 
-	// SaveURL saves a URL keyed by a name to be loaded later.
-	SaveURL(ctx context.Context, name string, url string, owners []string, shouldExpandDates bool) error
+	// SaveURL saves a URL keyed by its name to be loaded later. It returns an
+	// AlreadyExistsError if the name is already used.
+	SaveURL(ctx context.Context, u namedURL) error
+
+	// UpdateURL updates all the fields but the owners of an existing short URL
+	// keyed by its name, only if it's owned by one of the given principals
+	// (see isOwnedBy). If principals is nil, doesn't check for ownership. It
+	// returns the URL as it was before the update.
+	UpdateURL(ctx context.Context, u namedURL, principals []string) (namedURL, error)
+
+	// DeleteURL deletes a URL keyed by a name only if it's owned by one of the
+	// given principals. If principals is nil, doesn't check for ownership. It
+	// returns the URL that was deleted.
+	DeleteURL(ctx context.Context, name string, principals []string) (namedURL, error)
+
+	// AddOwners adds owners to a short URL, only if it's owned by one of the
+	// given principals. If principals is nil, doesn't check for ownership. The
+	// URL does not expire anymore. It returns the URL as it was before the
+	// change.
+	AddOwners(ctx context.Context, name string, owners []string, principals []string) (namedURL, error)
+
+	// RemoveOwners removes owners from a short URL, only if it's owned by one
+	// of the given principals and if at least one owner is left. If principals
+	// is nil, doesn't check for ownership. It returns the URL as it was before
+	// the change.
+	RemoveOwners(ctx context.Context, name string, owners []string, principals []string) (namedURL, error)
+
+	// SetOwners replaces all the owners of a short URL, only if it's owned by
+	// one of the given principals. If principals is nil, doesn't check for
+	// ownership. The URL does not expire anymore. It returns the URL as it was
+	// before the change.
+	SetOwners(ctx context.Context, name string, owners []string, principals []string) (namedURL, error)
+
+	// SaveRevision records a change made to a short URL.
+	SaveRevision(ctx context.Context, rev revision) error
 
-	// DeleteURL deletes a URL keyed by a name only if it's owned by the given
-	// user. If user is empty, doesn't check for ownership.
-	DeleteURL(ctx context.Context, name string, user string) error
+	// ListRevisions lists the changes made to a short URL, oldest first.
+	ListRevisions(ctx context.Context, name string) ([]revision, error)
+
+	// SearchURLs finds the URLs matching a free text query in their name,
+	// target or description. They are sorted from the best match and at most
+	// limit URLs are returned.
+	SearchURLs(ctx context.Context, query string, limit int) ([]namedURL, error)
+
+	// Ping checks that the database can be reached.
+	Ping(ctx context.Context) error
+
+	// Close releases the resources held by the database. It must not be used
+	// afterwards.
+	Close(ctx context.Context) error
 }
 
 // A NotFoundError is triggered if a name does not resolve to an URL in the
@@ -47,6 +247,28 @@ func (e NotFoundError) Error() string {
 	return fmt.Sprintf("no URL found with name %q", e.Name)
 }
 
+// An AlreadyExistsError is triggered when trying to save a URL with a name
+// that is already used in the database.
+type AlreadyExistsError struct {
+	Name string
+}
+
+func (e AlreadyExistsError) Error() string {
+	return fmt.Sprintf("a URL already exists with name %q", e.Name)
+}
+
+// isTimeout returns whether a database call failed because it took too long.
+func isTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || mongo.IsTimeout(err)
+}
+
+// isUnavailable returns whether a database call failed because the database
+// could not be reached.
+func isUnavailable(err error) bool {
+	return mongo.IsNetworkError(err) || errors.Is(err, mongo.ErrClientDisconnected) ||
+		errors.Is(err, bolt.ErrDatabaseNotOpen)
+}
+
 type mongoDatabase struct {
 	// URL is the URL to connect to the MongoDB:
 	//   [mongodb://][user:pass@]host1[:port1][,host2[:port2],...][/database][?options]
@@ -58,16 +280,107 @@ type mongoDatabase struct {
 	// Name of the collection to use.
 	CollectionName string
 
+	// Name of the collection to use for the history of changes.
+	HistoryCollectionName string
+
+	// Name of the collection to use for the stats of hits.
+	StatsCollectionName string
+
+	// Name of the collection to use for the API tokens.
+	TokensCollectionName string
+
+	// Name of the collection to use for the audit trail.
+	AuditCollectionName string
+
+	// clientMu protects connected and connecting. It is never held while
+	// connecting, so that callers waiting for a connection can give up when
+	// their context is done.
+	clientMu  sync.Mutex
 	connected *mongo.Client
+	// connecting is a semaphore held by the only caller trying to connect, so
+	// that concurrent first calls do not set up several connections.
+	connecting chan struct{}
+
+	textIndexMu  sync.Mutex
+	hasTextIndex bool
 }
 
+// minConnectBackoff and maxConnectBackoff bound the delay between two attempts
+// to connect to MongoDB. The delay doubles after each failed attempt.
+const (
+	minConnectBackoff = 100 * time.Millisecond
+	maxConnectBackoff = 5 * time.Second
+)
+
+// client returns the client connected to MongoDB, connecting lazily on the
+// first call. If the connection fails, it retries with an exponential backoff
+// until the context is done. Failed connections are not kept, so a later call
+// tries again. Concurrent callers wait for the one connecting, but not beyond
+// their own context.
 func (d *mongoDatabase) client(ctx context.Context) (*mongo.Client, error) {
-	if d.connected == nil {
-		var err error
-		d.connected, err = mongo.Connect(ctx, options.Client().ApplyURI(d.URL))
-		return d.connected, err
+	d.clientMu.Lock()
+	c, connecting := d.connected, d.connecting
+	if connecting == nil {
+		connecting = make(chan struct{}, 1)
+		d.connecting = connecting
+	}
+	d.clientMu.Unlock()
+	if c != nil {
+		return c, nil
+	}
+
+	select {
+	case connecting <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("Could not connect to MongoDB: %w", ctx.Err())
+	}
+	defer func() { <-connecting }()
+
+	// Another caller may have connected while this one was waiting.
+	d.clientMu.Lock()
+	c = d.connected
+	d.clientMu.Unlock()
+	if c != nil {
+		return c, nil
+	}
+
+	backoff := minConnectBackoff
+	for {
+		c, err := d.connect(ctx)
+		if err == nil {
+			d.clientMu.Lock()
+			d.connected = c
+			d.clientMu.Unlock()
+			return c, nil
+		}
+		log.Printf("Could not connect to MongoDB, retrying in %v: %v", backoff, err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("Could not connect to MongoDB: %w", err)
+		}
+		backoff *= 2
+		if backoff > maxConnectBackoff {
+			backoff = maxConnectBackoff
+		}
 	}
-	return d.connected, nil
+}
+
+// connect creates a new client and checks that it can reach MongoDB.
+func (d *mongoDatabase) connect(ctx context.Context) (*mongo.Client, error) {
+	c, err := mongo.Connect(ctx, options.Client().ApplyURI(d.URL))
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Ping(ctx, nil); err != nil {
+		// The client is dropped anyway, ignore errors while disconnecting.
+		c.Disconnect(context.Background())
+		return nil, err
+	}
+	return c, nil
 }
 
 func (d *mongoDatabase) collection(ctx context.Context) (*mongo.Collection, error) {
@@ -78,15 +391,89 @@ func (d *mongoDatabase) collection(ctx context.Context) (*mongo.Collection, erro
 	return c.Database(d.DBName).Collection(d.CollectionName), nil
 }
 
-func (d *mongoDatabase) ListURLs(ctx context.Context) (urls []namedURL, err error) {
-	c, err := d.collection(ctx)
+func (d *mongoDatabase) statsCollection(ctx context.Context) (*mongo.Collection, error) {
+	c, err := d.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.Database(d.DBName).Collection(d.StatsCollectionName), nil
+}
+
+func (d *mongoDatabase) tokensCollection(ctx context.Context) (*mongo.Collection, error) {
+	c, err := d.client(ctx)
 	if err != nil {
 		return nil, err
 	}
-	iter, err := c.Find(ctx, bson.D{}, options.Find().SetLimit(5000).SetSort(bson.D{{"_id", 1}}))
+	return c.Database(d.DBName).Collection(d.TokensCollectionName), nil
+}
+
+func (d *mongoDatabase) auditCollection(ctx context.Context) (*mongo.Collection, error) {
+	c, err := d.client(ctx)
 	if err != nil {
 		return nil, err
 	}
+	return c.Database(d.DBName).Collection(d.AuditCollectionName), nil
+}
+
+func (d *mongoDatabase) historyCollection(ctx context.Context) (*mongo.Collection, error) {
+	c, err := d.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.Database(d.DBName).Collection(d.HistoryCollectionName), nil
+}
+
+func (d *mongoDatabase) Ping(ctx context.Context) error {
+	c, err := d.client(ctx)
+	if err != nil {
+		return err
+	}
+	return c.Ping(ctx, nil)
+}
+
+func (d *mongoDatabase) Close(ctx context.Context) error {
+	d.clientMu.Lock()
+	defer d.clientMu.Unlock()
+	if d.connected == nil {
+		return nil
+	}
+	err := d.connected.Disconnect(ctx)
+	d.connected = nil
+	return err
+}
+
+func (d *mongoDatabase) ListURLs(ctx context.Context, q listQuery) (urls []namedURL, next string, err error) {
+	c, err := d.collection(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	nameFilter := bson.D{}
+	if q.After != "" {
+		nameFilter = append(nameFilter, bson.E{"$gt", q.After})
+	}
+	if q.NamePrefix != "" {
+		nameFilter = append(nameFilter, bson.E{"$regex", "^" + regexp.QuoteMeta(q.NamePrefix)})
+	}
+	filter := bson.D{}
+	if len(nameFilter) > 0 {
+		filter = append(filter, bson.E{"_id", nameFilter})
+	}
+	if q.Owner != "" {
+		filter = append(filter, bson.E{"owners", q.Owner})
+	}
+	if q.Domain != "" {
+		// Match the domain in the host part of the URL only.
+		filter = append(filter, bson.E{"url", bson.D{
+			{"$regex", "^[^:/?#]+://[^/?#]*" + regexp.QuoteMeta(q.Domain)},
+			{"$options", "i"},
+		}})
+	}
+	limit := q.limit()
+	// Fetch one more to know whether there is a next page.
+	iter, err := c.Find(ctx, filter, options.Find().SetLimit(int64(limit+1)).SetSort(bson.D{{"_id", 1}}))
+	if err != nil {
+		return nil, "", err
+	}
 	for iter.Next(ctx) {
 		var result namedURL
 		if err := iter.Decode(&result); err != nil {
@@ -95,7 +482,11 @@ func (d *mongoDatabase) ListURLs(ctx context.Context) (urls []namedURL, err erro
 		}
 		urls = append(urls, result)
 	}
-	return urls, iter.Close(ctx)
+	if len(urls) > limit {
+		urls = urls[:limit]
+		next = urls[limit-1].Name
+	}
+	return urls, next, iter.Close(ctx)
 }
 
 func (d *mongoDatabase) LoadURL(ctx context.Context, name string) (namedURL, error) {
@@ -114,30 +505,363 @@ func (d *mongoDatabase) LoadURL(ctx context.Context, name string) (namedURL, err
 	return result, nil
 }
 
-func (d *mongoDatabase) SaveURL(ctx context.Context, name string, url string, owners []string, shouldExpandDates bool) error {
+func (d *mongoDatabase) SaveURL(ctx context.Context, u namedURL) error {
 	c, err := d.collection(ctx)
 	if err != nil {
 		return err
 	}
-	_, err = c.InsertOne(ctx, bson.D{{"_id", name}, {"url", url}, {"owners", owners}, {"shouldExpandDates", shouldExpandDates}})
+	_, err = c.InsertOne(ctx, u)
+	if mongo.IsDuplicateKeyError(err) {
+		return AlreadyExistsError{u.Name}
+	}
 	return err
 }
 
-func (d *mongoDatabase) DeleteURL(ctx context.Context, name string, user string) error {
+func (d *mongoDatabase) UpdateURL(ctx context.Context, u namedURL, principals []string) (namedURL, error) {
 	c, err := d.collection(ctx)
 	if err != nil {
-		return err
+		return namedURL{}, err
+	}
+	filter := bson.D{{"_id", u.Name}}
+	if principals != nil {
+		filter = append(filter, bson.E{"owners", bson.D{{"$in", principals}}})
+	}
+	set := bson.D{{"url", u.URL}, {"shouldExpandDates", u.ShouldExpandDates}}
+	unset := bson.D{}
+	if u.Description != "" {
+		set = append(set, bson.E{"description", u.Description})
+	} else {
+		unset = append(unset, bson.E{"description", ""})
+	}
+	if u.Visibility != "" {
+		set = append(set, bson.E{"visibility", u.Visibility})
+	} else {
+		unset = append(unset, bson.E{"visibility", ""})
+	}
+	if len(u.Allowed) > 0 {
+		set = append(set, bson.E{"allowed", u.Allowed})
+	} else {
+		unset = append(unset, bson.E{"allowed", ""})
+	}
+	if u.Kind != "" {
+		set = append(set, bson.E{"kind", u.Kind})
+	} else {
+		unset = append(unset, bson.E{"kind", ""})
+	}
+	if u.FallbackURL != "" {
+		set = append(set, bson.E{"fallbackUrl", u.FallbackURL})
+	} else {
+		unset = append(unset, bson.E{"fallbackUrl", ""})
+	}
+	update := bson.D{{"$set", set}}
+	if len(unset) > 0 {
+		update = append(update, bson.E{"$unset", unset})
+	}
+	var before namedURL
+	err = c.FindOneAndUpdate(ctx, filter, update).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		return namedURL{}, fmt.Errorf("The short URL does not exist: %#v", u.Name)
+	}
+	return before, err
+}
+
+func (d *mongoDatabase) DeleteURL(ctx context.Context, name string, principals []string) (namedURL, error) {
+	c, err := d.collection(ctx)
+	if err != nil {
+		return namedURL{}, err
 	}
 	filter := bson.D{{"_id", name}}
-	if user != "" {
-		filter = append(filter, bson.E{"owners", user})
+	if principals != nil {
+		filter = append(filter, bson.E{"owners", bson.D{{"$in", principals}}})
+	}
+	var deleted namedURL
+	err = c.FindOneAndDelete(ctx, filter).Decode(&deleted)
+	if err == mongo.ErrNoDocuments {
+		return namedURL{}, fmt.Errorf("The short URL does not exist: %#v", name)
+	}
+	return deleted, err
+}
+
+// changeOwners applies an update to the owners of a short URL if it's owned by
+// one of the principals and matches the extra filter.
+func (d *mongoDatabase) changeOwners(ctx context.Context, name string, principals []string, extraFilter bson.D, update interface{}) (namedURL, error) {
+	c, err := d.collection(ctx)
+	if err != nil {
+		return namedURL{}, err
+	}
+	conditions := bson.A{bson.D{{"_id", name}}}
+	if principals != nil {
+		conditions = append(conditions, bson.D{{"owners", bson.D{{"$in", principals}}}})
+	}
+	if len(extraFilter) > 0 {
+		conditions = append(conditions, extraFilter)
+	}
+	var before namedURL
+	err = c.FindOneAndUpdate(ctx, bson.D{{"$and", conditions}}, update).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		return namedURL{}, fmt.Errorf("The short URL does not exist: %#v", name)
+	}
+	return before, err
+}
+
+func (d *mongoDatabase) AddOwners(ctx context.Context, name string, owners []string, principals []string) (namedURL, error) {
+	// An aggregation pipeline is used instead of $addToSet to also add owners
+	// to URLs that have none, i.e. where owners is null.
+	existing := bson.D{{"$ifNull", bson.A{"$owners", bson.A{}}}}
+	update := mongo.Pipeline{{{"$set", bson.D{{"owners", bson.D{{"$concatArrays", bson.A{
+		existing,
+		bson.D{{"$filter", bson.D{
+			{"input", addOwners(nil, owners)},
+			{"cond", bson.D{{"$not", bson.A{bson.D{{"$in", bson.A{"$$this", existing}}}}}}},
+		}}},
+	}}}}}}}, {{"$unset", "expiresAt"}}}
+	return d.changeOwners(ctx, name, principals, nil, update)
+}
+
+func (d *mongoDatabase) RemoveOwners(ctx context.Context, name string, owners []string, principals []string) (namedURL, error) {
+	// Only match the URL if it has an owner that is not removed.
+	keepOne := bson.D{{"owners", bson.D{{"$elemMatch", bson.D{{"$nin", owners}}}}}}
+	update := bson.D{{"$pullAll", bson.D{{"owners", owners}}}, {"$unset", bson.D{{"expiresAt", ""}}}}
+	return d.changeOwners(ctx, name, principals, keepOne, update)
+}
+
+func (d *mongoDatabase) SetOwners(ctx context.Context, name string, owners []string, principals []string) (namedURL, error) {
+	update := bson.D{{"$set", bson.D{{"owners", owners}}}, {"$unset", bson.D{{"expiresAt", ""}}}}
+	return d.changeOwners(ctx, name, principals, nil, update)
+}
+
+func (d *mongoDatabase) SaveRevision(ctx context.Context, rev revision) error {
+	c, err := d.historyCollection(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = c.InsertOne(ctx, rev)
+	return err
+}
+
+func (d *mongoDatabase) ListRevisions(ctx context.Context, name string) (revs []revision, err error) {
+	c, err := d.historyCollection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := c.Find(ctx, bson.D{{"name", name}}, options.Find().SetSort(bson.D{{"time", 1}, {"_id", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	for iter.Next(ctx) {
+		var result revision
+		if err := iter.Decode(&result); err != nil {
+			return nil, fmt.Errorf("Could not decode revision for %v: %w", name, err)
+		}
+		revs = append(revs, result)
+	}
+	return revs, iter.Close(ctx)
+}
+
+// ensureTextIndex creates the text index used by SearchURLs if needed.
+func (d *mongoDatabase) ensureTextIndex(ctx context.Context, c *mongo.Collection) error {
+	d.textIndexMu.Lock()
+	defer d.textIndexMu.Unlock()
+	if d.hasTextIndex {
+		return nil
+	}
+	_, err := c.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"url", "text"}, {"description", "text"}},
+		Options: options.Index().SetName("search"),
+	})
+	if err != nil {
+		return fmt.Errorf("Could not create the text index: %w", err)
+	}
+	d.hasTextIndex = true
+	return nil
+}
+
+func (d *mongoDatabase) SearchURLs(ctx context.Context, query string, limit int) ([]namedURL, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	c, err := d.collection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.ensureTextIndex(ctx, c); err != nil {
+		return nil, err
+	}
+
+	// The text index finds the candidates by target and description. Names
+	// are matched separately as text search only matches whole words while
+	// users often type the beginning of a name.
+	namePatterns := make([]string, len(terms))
+	for i, term := range terms {
+		namePatterns[i] = regexp.QuoteMeta(term)
+	}
+	filters := []bson.D{
+		{{"$text", bson.D{{"$search", query}}}},
+		{{"_id", bson.D{{"$regex", strings.Join(namePatterns, "|")}, {"$options", "i"}}}},
+	}
+	seen := map[string]bool{}
+	var candidates []namedURL
+	for _, filter := range filters {
+		iter, err := c.Find(ctx, filter, options.Find().SetLimit(maxListedURLs))
+		if err != nil {
+			return nil, err
+		}
+		for iter.Next(ctx) {
+			var result namedURL
+			if err := iter.Decode(&result); err != nil {
+				// Just skip it if you cannot retrieve the info.
+				continue
+			}
+			if !seen[result.Name] {
+				seen[result.Name] = true
+				candidates = append(candidates, result)
+			}
+		}
+		if err := iter.Close(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return rankURLs(candidates, terms, limit), nil
+}
+
+func (d *mongoDatabase) AddHits(ctx context.Context, name string, day string, count int, lastUsed time.Time) error {
+	c, err := d.statsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = c.UpdateOne(ctx, bson.D{{"_id", name}}, bson.D{
+		{"$inc", bson.D{{"hits", count}, {"daily." + day, count}}},
+		{"$max", bson.D{{"lastUsed", lastUsed}}},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+func (d *mongoDatabase) LoadStats(ctx context.Context, names []string) (map[string]linkStats, error) {
+	c, err := d.statsCollection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := c.Find(ctx, bson.D{{"_id", bson.D{{"$in", names}}}})
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]linkStats{}
+	for iter.Next(ctx) {
+		var stats linkStats
+		if err := iter.Decode(&stats); err != nil {
+			// Just skip it if you cannot retrieve the info.
+			continue
+		}
+		result[stats.Name] = stats
+	}
+	return result, iter.Close(ctx)
+}
+
+func (d *mongoDatabase) SaveToken(ctx context.Context, t apiToken) error {
+	c, err := d.tokensCollection(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = c.InsertOne(ctx, t)
+	return err
+}
+
+func (d *mongoDatabase) LoadToken(ctx context.Context, hash string) (apiToken, error) {
+	c, err := d.tokensCollection(ctx)
+	if err != nil {
+		return apiToken{}, err
+	}
+	var result apiToken
+	err = c.FindOne(ctx, bson.D{{"_id", hash}}).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return apiToken{}, TokenNotFoundError{}
+	}
+	if err != nil {
+		return apiToken{}, fmt.Errorf("Could not decode token: %w", err)
+	}
+	return result, nil
+}
+
+func (d *mongoDatabase) ListTokens(ctx context.Context, user string) (tokens []apiToken, err error) {
+	c, err := d.tokensCollection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := c.Find(ctx, bson.D{{"user", user}}, options.Find().SetSort(bson.D{{"created", 1}, {"id", 1}}))
+	if err != nil {
+		return nil, err
 	}
-	r, err := c.DeleteOne(ctx, filter)
+	for iter.Next(ctx) {
+		var result apiToken
+		if err := iter.Decode(&result); err != nil {
+			return nil, fmt.Errorf("Could not decode token: %w", err)
+		}
+		tokens = append(tokens, result)
+	}
+	return tokens, iter.Close(ctx)
+}
+
+func (d *mongoDatabase) DeleteToken(ctx context.Context, id string, user string) error {
+	c, err := d.tokensCollection(ctx)
 	if err != nil {
 		return err
 	}
-	if r.DeletedCount != 1 {
-		return fmt.Errorf("The short URL does not exist: %#v", name)
+	result, err := c.DeleteOne(ctx, bson.D{{"id", id}, {"user", user}})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return TokenNotFoundError{}
 	}
 	return nil
 }
+
+func (d *mongoDatabase) RecordAudit(ctx context.Context, entry auditEntry) error {
+	c, err := d.auditCollection(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = c.InsertOne(ctx, entry)
+	return err
+}
+
+func (d *mongoDatabase) ListAudit(ctx context.Context, q auditQuery) (entries []auditEntry, err error) {
+	c, err := d.auditCollection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.D{}
+	if q.User != "" {
+		filter = append(filter, bson.E{"user", q.User})
+	}
+	if q.Name != "" {
+		filter = append(filter, bson.E{"name", q.Name})
+	}
+	if q.Action != "" {
+		filter = append(filter, bson.E{"action", q.Action})
+	}
+	timeRange := bson.D{}
+	if !q.Since.IsZero() {
+		timeRange = append(timeRange, bson.E{"$gte", q.Since})
+	}
+	if !q.Until.IsZero() {
+		timeRange = append(timeRange, bson.E{"$lt", q.Until})
+	}
+	if len(timeRange) > 0 {
+		filter = append(filter, bson.E{"time", timeRange})
+	}
+	opts := options.Find().SetSort(bson.D{{"time", -1}, {"_id", -1}}).SetLimit(int64(q.limit()))
+	iter, err := c.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	for iter.Next(ctx) {
+		var entry auditEntry
+		if err := iter.Decode(&entry); err != nil {
+			return nil, fmt.Errorf("Could not decode audit entry: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, iter.Close(ctx)
+}
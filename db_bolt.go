@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// urlsBucket is the name of the bolt bucket containing the URLs, keyed by
+// name.
+var urlsBucket = []byte("shortURL")
+
+// historyBucket is the name of the bolt bucket containing the revisions. It
+// has one nested bucket per short name, where revisions are keyed by sequence
+// number.
+var historyBucket = []byte("shortURLHistory")
+
+// statsBucket is the name of the bolt bucket containing the linkStats, keyed
+// by name.
+var statsBucket = []byte("shortURLStats")
+
+// tokensBucket is the name of the bolt bucket containing the apiTokens, keyed
+// by hash.
+var tokensBucket = []byte("shortURLTokens")
+
+// auditBucket is the name of the bolt bucket containing the auditEntries,
+// keyed by sequence number.
+var auditBucket = []byte("shortURLAudit")
+
+// A boltDatabase stores the URLs in a single file using an embedded key/value
+// store, so that it does not need any other server to run.
+type boltDatabase struct {
+	db *bolt.DB
+}
+
+// newBoltDatabase opens or creates the bolt file at the given path.
+func newBoltDatabase(path string) (*boltDatabase, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Could not open bolt file %q: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(urlsBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(historyBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(statsBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(tokensBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(auditBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltDatabase{db: db}, nil
+}
+
+// Ping checks that the bolt file is still open.
+func (d *boltDatabase) Ping(ctx context.Context) error {
+	return d.db.View(func(tx *bolt.Tx) error { return nil })
+}
+
+func (d *boltDatabase) Close(ctx context.Context) error {
+	return d.db.Close()
+}
+
+func (d *boltDatabase) ListURLs(ctx context.Context, q listQuery) (urls []namedURL, next string, err error) {
+	limit := q.limit()
+	err = d.db.View(func(tx *bolt.Tx) error {
+		start := q.NamePrefix
+		if q.After > start {
+			start = q.After
+		}
+		// Bolt iterates keys in byte-sorted order.
+		c := tx.Bucket(urlsBucket).Cursor()
+		for k, v := c.Seek([]byte(start)); k != nil; k, v = c.Next() {
+			if string(k) <= q.After {
+				continue
+			}
+			if !bytes.HasPrefix(k, []byte(q.NamePrefix)) {
+				break
+			}
+			var result namedURL
+			if err := json.Unmarshal(v, &result); err != nil {
+				// Just skip it if you cannot retrieve the info.
+				continue
+			}
+			if !q.matches(result) {
+				continue
+			}
+			if len(urls) == limit {
+				next = urls[limit-1].Name
+				break
+			}
+			urls = append(urls, result)
+		}
+		return nil
+	})
+	return urls, next, err
+}
+
+func (d *boltDatabase) LoadURL(ctx context.Context, name string) (result namedURL, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(urlsBucket).Get([]byte(name))
+		if v == nil {
+			return NotFoundError{name}
+		}
+		if err := json.Unmarshal(v, &result); err != nil {
+			return fmt.Errorf("Could not decode URL object for %v: %w", name, err)
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (d *boltDatabase) SaveURL(ctx context.Context, u namedURL) error {
+	v, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(urlsBucket)
+		if b.Get([]byte(u.Name)) != nil {
+			return AlreadyExistsError{u.Name}
+		}
+		return b.Put([]byte(u.Name), v)
+	})
+}
+
+func (d *boltDatabase) UpdateURL(ctx context.Context, u namedURL, principals []string) (before namedURL, err error) {
+	err = d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(urlsBucket)
+		before, err = loadOwnedURL(b, u.Name, principals)
+		if err != nil {
+			return err
+		}
+		u.Owners = before.Owners
+		u.ExpiresAt = before.ExpiresAt
+		v, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(u.Name), v)
+	})
+	return before, err
+}
+
+func (d *boltDatabase) DeleteURL(ctx context.Context, name string, principals []string) (deleted namedURL, err error) {
+	err = d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(urlsBucket)
+		deleted, err = loadOwnedURL(b, name, principals)
+		if err != nil {
+			return err
+		}
+		return b.Delete([]byte(name))
+	})
+	return deleted, err
+}
+
+func (d *boltDatabase) AddOwners(ctx context.Context, name string, owners []string, principals []string) (namedURL, error) {
+	return d.changeOwners(name, principals, func(u namedURL) ([]string, error) {
+		return addOwners(u.Owners, owners), nil
+	})
+}
+
+func (d *boltDatabase) RemoveOwners(ctx context.Context, name string, owners []string, principals []string) (namedURL, error) {
+	return d.changeOwners(name, principals, func(u namedURL) ([]string, error) {
+		return removeLastOwners(u, owners)
+	})
+}
+
+func (d *boltDatabase) SetOwners(ctx context.Context, name string, owners []string, principals []string) (namedURL, error) {
+	return d.changeOwners(name, principals, func(u namedURL) ([]string, error) {
+		return owners, nil
+	})
+}
+
+// changeOwners replaces the owners of a URL by the ones computed by change if
+// it's owned by one of the principals.
+func (d *boltDatabase) changeOwners(name string, principals []string, change func(namedURL) ([]string, error)) (before namedURL, err error) {
+	err = d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(urlsBucket)
+		before, err = loadOwnedURL(b, name, principals)
+		if err != nil {
+			return err
+		}
+		after := before
+		if after.Owners, err = change(before); err != nil {
+			return err
+		}
+		after.ExpiresAt = nil
+		v, err := json.Marshal(after)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(name), v)
+	})
+	return before, err
+}
+
+func (d *boltDatabase) SaveRevision(ctx context.Context, rev revision) error {
+	v, err := json.Marshal(rev)
+	if err != nil {
+		return err
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(historyBucket).CreateBucketIfNotExists([]byte(rev.Name))
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return b.Put(key, v)
+	})
+}
+
+func (d *boltDatabase) ListRevisions(ctx context.Context, name string) (revs []revision, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyBucket).Bucket([]byte(name))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var result revision
+			if err := json.Unmarshal(v, &result); err != nil {
+				return fmt.Errorf("Could not decode revision for %v: %w", name, err)
+			}
+			revs = append(revs, result)
+			return nil
+		})
+	})
+	return revs, err
+}
+
+func (d *boltDatabase) SearchURLs(ctx context.Context, query string, limit int) (urls []namedURL, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(urlsBucket).ForEach(func(k, v []byte) error {
+			var result namedURL
+			if err := json.Unmarshal(v, &result); err != nil {
+				// Just skip it if you cannot retrieve the info.
+				return nil
+			}
+			urls = append(urls, result)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rankURLs(urls, searchTerms(query), limit), nil
+}
+
+func (d *boltDatabase) AddHits(ctx context.Context, name string, day string, count int, lastUsed time.Time) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(statsBucket)
+		stats := linkStats{Name: name}
+		if v := b.Get([]byte(name)); v != nil {
+			if err := json.Unmarshal(v, &stats); err != nil {
+				return fmt.Errorf("Could not decode stats for %v: %w", name, err)
+			}
+		}
+		stats.Hits += count
+		if stats.LastUsed == nil || lastUsed.After(*stats.LastUsed) {
+			stats.LastUsed = &lastUsed
+		}
+		if stats.Daily == nil {
+			stats.Daily = map[string]int{}
+		}
+		stats.Daily[day] += count
+		v, err := json.Marshal(stats)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(name), v)
+	})
+}
+
+func (d *boltDatabase) LoadStats(ctx context.Context, names []string) (map[string]linkStats, error) {
+	result := map[string]linkStats{}
+	err := d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(statsBucket)
+		for _, name := range names {
+			v := b.Get([]byte(name))
+			if v == nil {
+				continue
+			}
+			var stats linkStats
+			if err := json.Unmarshal(v, &stats); err != nil {
+				return fmt.Errorf("Could not decode stats for %v: %w", name, err)
+			}
+			result[name] = stats
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (d *boltDatabase) SaveToken(ctx context.Context, t apiToken) error {
+	v, err := json.Marshal(storedToken{t, t.Hash})
+	if err != nil {
+		return err
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(tokensBucket).Put([]byte(t.Hash), v)
+	})
+}
+
+func (d *boltDatabase) LoadToken(ctx context.Context, hash string) (t apiToken, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(tokensBucket).Get([]byte(hash))
+		if v == nil {
+			return TokenNotFoundError{}
+		}
+		var stored storedToken
+		if err := json.Unmarshal(v, &stored); err != nil {
+			return fmt.Errorf("Could not decode token: %w", err)
+		}
+		t = stored.token()
+		return nil
+	})
+	return t, err
+}
+
+func (d *boltDatabase) ListTokens(ctx context.Context, user string) (tokens []apiToken, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(tokensBucket).ForEach(func(k, v []byte) error {
+			var stored storedToken
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return fmt.Errorf("Could not decode token: %w", err)
+			}
+			if stored.User == user {
+				tokens = append(tokens, stored.token())
+			}
+			return nil
+		})
+	})
+	sortTokens(tokens)
+	return tokens, err
+}
+
+func (d *boltDatabase) DeleteToken(ctx context.Context, id string, user string) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(tokensBucket)
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var stored storedToken
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return fmt.Errorf("Could not decode token: %w", err)
+			}
+			if stored.ID == id && stored.User == user {
+				return c.Delete()
+			}
+		}
+		return TokenNotFoundError{}
+	})
+}
+
+// A storedToken is how an apiToken is encoded in bolt: its hash is hidden
+// from the JSON encoding of apiToken.
+type storedToken struct {
+	apiToken
+	Hash string `json:"hash"`
+}
+
+func (s storedToken) token() apiToken {
+	t := s.apiToken
+	t.Hash = s.Hash
+	return t
+}
+
+// loadOwnedURL loads a URL from the bucket only if it's owned by one of the
+// given principals. If principals is nil, doesn't check for ownership.
+func loadOwnedURL(b *bolt.Bucket, name string, principals []string) (namedURL, error) {
+	v := b.Get([]byte(name))
+	if v == nil {
+		return namedURL{}, fmt.Errorf("The short URL does not exist: %#v", name)
+	}
+	var result namedURL
+	if err := json.Unmarshal(v, &result); err != nil {
+		return namedURL{}, fmt.Errorf("Could not decode URL object for %v: %w", name, err)
+	}
+	if !isOwnedBy(result, principals) {
+		return namedURL{}, fmt.Errorf("The short URL does not exist: %#v", name)
+	}
+	return result, nil
+}
+
+func (d *boltDatabase) RecordAudit(ctx context.Context, entry auditEntry) error {
+	v, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(auditBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return b.Put(key, v)
+	})
+}
+
+func (d *boltDatabase) ListAudit(ctx context.Context, q auditQuery) (entries []auditEntry, err error) {
+	limit := q.limit()
+	err = d.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(auditBucket).Cursor()
+		for k, v := c.Last(); k != nil && len(entries) < limit; k, v = c.Prev() {
+			var entry auditEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("Could not decode audit entry: %w", err)
+			}
+			if q.matches(entry) {
+				entries = append(entries, entry)
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
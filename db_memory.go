@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A memoryDatabase keeps all the URLs in memory: they are lost when the
+// process stops. It is useful for local runs and tests. Its zero value is an
+// empty database ready to use.
+type memoryDatabase struct {
+	mu        sync.RWMutex
+	urls      map[string]namedURL
+	revisions map[string][]revision
+	stats     map[string]linkStats
+	// tokens are keyed by hash.
+	tokens map[string]apiToken
+	// audit is sorted from the oldest entry.
+	audit []auditEntry
+}
+
+// Ping always succeeds as there is nothing to reach.
+func (d *memoryDatabase) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close does nothing: the URLs are simply lost.
+func (d *memoryDatabase) Close(ctx context.Context) error {
+	return nil
+}
+
+func (d *memoryDatabase) ListURLs(ctx context.Context, q listQuery) (urls []namedURL, next string, err error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	names := make([]string, 0, len(d.urls))
+	for name := range d.urls {
+		if name > q.After {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	limit := q.limit()
+	for _, name := range names {
+		u := d.urls[name]
+		if !q.matches(u) {
+			continue
+		}
+		if len(urls) == limit {
+			return urls, urls[limit-1].Name, nil
+		}
+		urls = append(urls, copyNamedURL(u))
+	}
+	return urls, "", nil
+}
+
+func (d *memoryDatabase) LoadURL(ctx context.Context, name string) (namedURL, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	u, ok := d.urls[name]
+	if !ok {
+		return namedURL{}, NotFoundError{name}
+	}
+	return copyNamedURL(u), nil
+}
+
+func (d *memoryDatabase) SaveURL(ctx context.Context, u namedURL) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.urls[u.Name]; ok {
+		return AlreadyExistsError{u.Name}
+	}
+	if d.urls == nil {
+		d.urls = map[string]namedURL{}
+	}
+	d.urls[u.Name] = copyNamedURL(u)
+	return nil
+}
+
+func (d *memoryDatabase) UpdateURL(ctx context.Context, u namedURL, principals []string) (namedURL, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	before, ok := d.urls[u.Name]
+	if !ok || !isOwnedBy(before, principals) {
+		return namedURL{}, fmt.Errorf("The short URL does not exist: %#v", u.Name)
+	}
+	u.Owners = before.Owners
+	u.ExpiresAt = before.ExpiresAt
+	d.urls[u.Name] = copyNamedURL(u)
+	return copyNamedURL(before), nil
+}
+
+func (d *memoryDatabase) DeleteURL(ctx context.Context, name string, principals []string) (namedURL, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	u, ok := d.urls[name]
+	if !ok || !isOwnedBy(u, principals) {
+		return namedURL{}, fmt.Errorf("The short URL does not exist: %#v", name)
+	}
+	delete(d.urls, name)
+	return u, nil
+}
+
+func (d *memoryDatabase) AddOwners(ctx context.Context, name string, owners []string, principals []string) (namedURL, error) {
+	return d.changeOwners(name, principals, func(u namedURL) ([]string, error) {
+		return addOwners(u.Owners, owners), nil
+	})
+}
+
+func (d *memoryDatabase) RemoveOwners(ctx context.Context, name string, owners []string, principals []string) (namedURL, error) {
+	return d.changeOwners(name, principals, func(u namedURL) ([]string, error) {
+		return removeLastOwners(u, owners)
+	})
+}
+
+func (d *memoryDatabase) SetOwners(ctx context.Context, name string, owners []string, principals []string) (namedURL, error) {
+	return d.changeOwners(name, principals, func(u namedURL) ([]string, error) {
+		return append([]string{}, owners...), nil
+	})
+}
+
+// changeOwners replaces the owners of a URL by the ones computed by change if
+// it's owned by one of the principals.
+func (d *memoryDatabase) changeOwners(name string, principals []string, change func(namedURL) ([]string, error)) (namedURL, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	before, ok := d.urls[name]
+	if !ok || !isOwnedBy(before, principals) {
+		return namedURL{}, fmt.Errorf("The short URL does not exist: %#v", name)
+	}
+	owners, err := change(before)
+	if err != nil {
+		return namedURL{}, err
+	}
+	after := copyNamedURL(before)
+	after.Owners = owners
+	after.ExpiresAt = nil
+	d.urls[name] = after
+	return copyNamedURL(before), nil
+}
+
+func (d *memoryDatabase) SaveRevision(ctx context.Context, rev revision) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.revisions == nil {
+		d.revisions = map[string][]revision{}
+	}
+	d.revisions[rev.Name] = append(d.revisions[rev.Name], copyRevision(rev))
+	return nil
+}
+
+func (d *memoryDatabase) ListRevisions(ctx context.Context, name string) ([]revision, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var revs []revision
+	for _, rev := range d.revisions[name] {
+		revs = append(revs, copyRevision(rev))
+	}
+	return revs, nil
+}
+
+func (d *memoryDatabase) SearchURLs(ctx context.Context, query string, limit int) ([]namedURL, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var urls []namedURL
+	for _, u := range d.urls {
+		urls = append(urls, copyNamedURL(u))
+	}
+	return rankURLs(urls, searchTerms(query), limit), nil
+}
+
+func (d *memoryDatabase) AddHits(ctx context.Context, name string, day string, count int, lastUsed time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stats == nil {
+		d.stats = map[string]linkStats{}
+	}
+	stats := copyLinkStats(d.stats[name])
+	stats.Name = name
+	stats.Hits += count
+	if stats.LastUsed == nil || lastUsed.After(*stats.LastUsed) {
+		stats.LastUsed = &lastUsed
+	}
+	if stats.Daily == nil {
+		stats.Daily = map[string]int{}
+	}
+	stats.Daily[day] += count
+	d.stats[name] = stats
+	return nil
+}
+
+func (d *memoryDatabase) LoadStats(ctx context.Context, names []string) (map[string]linkStats, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	result := map[string]linkStats{}
+	for _, name := range names {
+		if stats, ok := d.stats[name]; ok {
+			result[name] = copyLinkStats(stats)
+		}
+	}
+	return result, nil
+}
+
+func (d *memoryDatabase) SaveToken(ctx context.Context, t apiToken) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.tokens == nil {
+		d.tokens = map[string]apiToken{}
+	}
+	d.tokens[t.Hash] = t
+	return nil
+}
+
+func (d *memoryDatabase) LoadToken(ctx context.Context, hash string) (apiToken, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	t, ok := d.tokens[hash]
+	if !ok {
+		return apiToken{}, TokenNotFoundError{}
+	}
+	return t, nil
+}
+
+func (d *memoryDatabase) ListTokens(ctx context.Context, user string) ([]apiToken, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var tokens []apiToken
+	for _, t := range d.tokens {
+		if t.User == user {
+			tokens = append(tokens, t)
+		}
+	}
+	sortTokens(tokens)
+	return tokens, nil
+}
+
+func (d *memoryDatabase) DeleteToken(ctx context.Context, id string, user string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for hash, t := range d.tokens {
+		if t.ID == id && t.User == user {
+			delete(d.tokens, hash)
+			return nil
+		}
+	}
+	return TokenNotFoundError{}
+}
+
+// copyNamedURL returns a deep copy of a namedURL so that the caller cannot
+// modify the stored version.
+func copyNamedURL(u namedURL) namedURL {
+	if u.Owners != nil {
+		u.Owners = append([]string{}, u.Owners...)
+	}
+	if u.Allowed != nil {
+		u.Allowed = append([]string{}, u.Allowed...)
+	}
+	if u.ExpiresAt != nil {
+		expiresAt := *u.ExpiresAt
+		u.ExpiresAt = &expiresAt
+	}
+	return u
+}
+
+// copyRevision returns a deep copy of a revision so that the caller cannot
+// modify the stored version.
+func copyRevision(rev revision) revision {
+	rev.Before = copyURLPointer(rev.Before)
+	rev.After = copyURLPointer(rev.After)
+	return rev
+}
+
+// copyURLPointer returns a pointer to a deep copy of a namedURL, or nil.
+func copyURLPointer(u *namedURL) *namedURL {
+	if u == nil {
+		return nil
+	}
+	c := copyNamedURL(*u)
+	return &c
+}
+
+// copyLinkStats returns a deep copy of linkStats so that the caller cannot
+// modify the stored version.
+func copyLinkStats(stats linkStats) linkStats {
+	if stats.LastUsed != nil {
+		lastUsed := *stats.LastUsed
+		stats.LastUsed = &lastUsed
+	}
+	if stats.Daily != nil {
+		daily := make(map[string]int, len(stats.Daily))
+		for day, count := range stats.Daily {
+			daily[day] = count
+		}
+		stats.Daily = daily
+	}
+	return stats
+}
+
+func (d *memoryDatabase) RecordAudit(ctx context.Context, entry auditEntry) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry.Before = copyURLPointer(entry.Before)
+	entry.After = copyURLPointer(entry.After)
+	d.audit = append(d.audit, entry)
+	return nil
+}
+
+func (d *memoryDatabase) ListAudit(ctx context.Context, q auditQuery) ([]auditEntry, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var entries []auditEntry
+	for _, entry := range d.audit {
+		if q.matches(entry) {
+			entry.Before = copyURLPointer(entry.Before)
+			entry.After = copyURLPointer(entry.After)
+			entries = append(entries, entry)
+		}
+	}
+	return latestAudit(entries, q.limit()), nil
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryDatabase(t *testing.T) {
+	testDatabase(t, &memoryDatabase{})
+	testStatsStore(t, &memoryDatabase{})
+	testTokenStore(t, &memoryDatabase{})
+}
+
+func TestBoltDatabase(t *testing.T) {
+	db, err := newBoltDatabase(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Could not open bolt database: %v", err)
+	}
+	testDatabase(t, db)
+	testStatsStore(t, db)
+	testTokenStore(t, db)
+
+	if err := db.Close(context.Background()); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if err := db.Ping(context.Background()); err == nil {
+		t.Errorf("Ping should fail once the database is closed")
+	}
+}
+
+// TestMongoDatabase runs against the MongoDB server given in the
+// MONGODB_TEST_URL env variable, e.g. mongodb://localhost, and is skipped if
+// it is not set. It uses a new database that is dropped afterwards.
+func TestMongoDatabase(t *testing.T) {
+	url := os.Getenv("MONGODB_TEST_URL")
+	if url == "" {
+		t.Skip("MONGODB_TEST_URL is not set")
+	}
+	db := &mongoDatabase{
+		URL:                   url,
+		DBName:                fmt.Sprintf("url-shortener-test-%d", time.Now().UnixNano()),
+		CollectionName:        "shortURL",
+		HistoryCollectionName: "shortURLHistory",
+		StatsCollectionName:   "shortURLStats",
+		TokensCollectionName:  "shortURLTokens",
+		AuditCollectionName:   "shortURLAudit",
+	}
+	ctx := context.Background()
+	defer db.Close(ctx)
+	defer func() {
+		if c, err := db.client(ctx); err == nil {
+			c.Database(db.DBName).Drop(ctx)
+		}
+	}()
+
+	testDatabase(t, db)
+	testStatsStore(t, db)
+	testTokenStore(t, db)
+}
+
+func TestMongoDatabaseUnreachable(t *testing.T) {
+	db := &mongoDatabase{
+		// Nothing listens on port 1.
+		URL:            "mongodb://127.0.0.1:1/?serverSelectionTimeoutMS=50&connectTimeoutMS=50",
+		DBName:         "url-shortener",
+		CollectionName: "shortURL",
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			_, errs[i] = db.LoadURL(ctx, "wiki")
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err == nil {
+			t.Errorf("LoadURL #%d should fail when MongoDB is unreachable", i)
+		}
+	}
+	if db.connected != nil {
+		t.Errorf("A client was kept although it could not connect")
+	}
+	if err := db.Close(context.Background()); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+}
+
+func TestMongoDatabaseWaitingForConnection(t *testing.T) {
+	db := &mongoDatabase{
+		// Nothing listens on port 1.
+		URL:            "mongodb://127.0.0.1:1/?serverSelectionTimeoutMS=50&connectTimeoutMS=50",
+		DBName:         "url-shortener",
+		CollectionName: "shortURL",
+	}
+
+	// A first caller keeps retrying to connect for a while.
+	slowCtx, cancelSlow := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelSlow()
+	slowDone := make(chan struct{})
+	go func() {
+		defer close(slowDone)
+		db.LoadURL(slowCtx, "wiki")
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := db.LoadURL(ctx, "wiki")
+	if err == nil {
+		t.Errorf("LoadURL should fail when MongoDB is unreachable")
+	} else if !isTimeout(err) {
+		t.Errorf("LoadURL failed with %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("LoadURL waited %v for another caller to connect, want about its own deadline", elapsed)
+	}
+
+	cancelSlow()
+	<-slowDone
+}
+
+func TestMemoryDatabaseConcurrency(t *testing.T) {
+	db := &memoryDatabase{}
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("link%d", i)
+			if err := db.SaveURL(ctx, namedURL{Name: name, URL: "http://example.com", Owners: []string{"lascap"}}); err != nil {
+				t.Errorf("SaveURL(%q) failed: %v", name, err)
+			}
+			if _, err := db.LoadURL(ctx, name); err != nil {
+				t.Errorf("LoadURL(%q) failed: %v", name, err)
+			}
+			if _, _, err := db.ListURLs(ctx, listQuery{}); err != nil {
+				t.Errorf("ListURLs() failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	urls, _, err := db.ListURLs(ctx, listQuery{})
+	if err != nil {
+		t.Fatalf("ListURLs() failed: %v", err)
+	}
+	if got, want := len(urls), 20; got != want {
+		t.Errorf("ListURLs() returned %d URLs, want %d", got, want)
+	}
+}
+
+// testDatabase checks the behavior shared by all implementations of database.
+// The db must be empty when calling this function.
+func testDatabase(t *testing.T, db database) {
+	ctx := context.Background()
+
+	if err := db.Ping(ctx); err != nil {
+		t.Errorf("Ping failed: %v", err)
+	}
+
+	if _, err := db.LoadURL(ctx, "wiki"); err != (NotFoundError{"wiki"}) {
+		t.Errorf("LoadURL on an empty DB returned %v, want a NotFoundError", err)
+	}
+
+	if urls, next, err := db.ListURLs(ctx, listQuery{}); err != nil || len(urls) != 0 || next != "" {
+		t.Errorf("ListURLs on an empty DB returned %v, %q, %v", urls, next, err)
+	}
+
+	if err := db.SaveURL(ctx, namedURL{Name: "wiki", URL: "http://github.com/bayesimpact/wiki", Owners: []string{"lascap"}}); err != nil {
+		t.Fatalf("SaveURL failed: %v", err)
+	}
+	if err := db.SaveURL(ctx, namedURL{Name: "google", URL: "http://www.google.com", ShouldExpandDates: true}); err != nil {
+		t.Fatalf("SaveURL failed: %v", err)
+	}
+
+	if err := db.SaveURL(ctx, namedURL{Name: "wiki", URL: "http://en.wikipedia.org"}); err != (AlreadyExistsError{"wiki"}) {
+		t.Errorf("SaveURL on an existing name returned %v, want an AlreadyExistsError", err)
+	}
+
+	wiki := namedURL{
+		Name:   "wiki",
+		URL:    "http://github.com/bayesimpact/wiki",
+		Owners: []string{"lascap"},
+	}
+	if got, err := db.LoadURL(ctx, "wiki"); err != nil {
+		t.Errorf("LoadURL failed: %v", err)
+	} else if !reflect.DeepEqual(got, wiki) {
+		t.Errorf("LoadURL returned %#v, want %#v", got, wiki)
+	}
+
+	if err := db.SaveURL(ctx, namedURL{Name: "wikipedia", URL: "https://EN.wikipedia.org/wiki", Owners: []string{"other"}, Description: "The free encyclopedia"}); err != nil {
+		t.Fatalf("SaveURL failed: %v", err)
+	}
+
+	listTests := []struct {
+		desc        string
+		query       listQuery
+		expectNames []string
+		expectNext  string
+	}{
+		{
+			desc:        "All",
+			expectNames: []string{"google", "wiki", "wikipedia"},
+		},
+		{
+			desc:        "First page",
+			query:       listQuery{Limit: 2},
+			expectNames: []string{"google", "wiki"},
+			expectNext:  "wiki",
+		},
+		{
+			desc:        "Last page",
+			query:       listQuery{After: "wiki", Limit: 2},
+			expectNames: []string{"wikipedia"},
+		},
+		{
+			desc:        "Page exactly at the end",
+			query:       listQuery{After: "google", Limit: 2},
+			expectNames: []string{"wiki", "wikipedia"},
+		},
+		{
+			desc:        "Owner",
+			query:       listQuery{Owner: "lascap"},
+			expectNames: []string{"wiki"},
+		},
+		{
+			desc:        "Prefix",
+			query:       listQuery{NamePrefix: "wiki"},
+			expectNames: []string{"wiki", "wikipedia"},
+		},
+		{
+			desc:        "Prefix after cursor",
+			query:       listQuery{NamePrefix: "wiki", After: "wiki"},
+			expectNames: []string{"wikipedia"},
+		},
+		{
+			desc:        "Domain",
+			query:       listQuery{Domain: "wikipedia.ORG"},
+			expectNames: []string{"wikipedia"},
+		},
+		{
+			desc:        "Domain only in the path",
+			query:       listQuery{Domain: "wiki"},
+			expectNames: []string{"wikipedia"},
+		},
+	}
+	for _, test := range listTests {
+		urls, next, err := db.ListURLs(ctx, test.query)
+		if err != nil {
+			t.Errorf("%s: ListURLs failed: %v", test.desc, err)
+			continue
+		}
+		var names []string
+		for _, u := range urls {
+			names = append(names, u.Name)
+		}
+		if !reflect.DeepEqual(names, test.expectNames) {
+			t.Errorf("%s: ListURLs returned %q, want %q", test.desc, names, test.expectNames)
+		}
+		if next != test.expectNext {
+			t.Errorf("%s: ListURLs returned next cursor %q, want %q", test.desc, next, test.expectNext)
+		}
+	}
+
+	searchTests := []struct {
+		query       string
+		limit       int
+		expectNames []string
+	}{
+		{"wiki", 10, []string{"wiki", "wikipedia"}},
+		{"wiki", 1, []string{"wiki"}},
+		{"WIKI encyclopedia", 10, []string{"wikipedia"}},
+		{"google.com", 10, []string{"google"}},
+		{"nothing", 10, nil},
+		{"", 10, nil},
+	}
+	for _, test := range searchTests {
+		urls, err := db.SearchURLs(ctx, test.query, test.limit)
+		if err != nil {
+			t.Errorf("SearchURLs(%q) failed: %v", test.query, err)
+			continue
+		}
+		var names []string
+		for _, u := range urls {
+			names = append(names, u.Name)
+		}
+		if !reflect.DeepEqual(names, test.expectNames) {
+			t.Errorf("SearchURLs(%q, %d) returned %q, want %q", test.query, test.limit, names, test.expectNames)
+		}
+	}
+
+	if _, err := db.DeleteURL(ctx, "wikipedia", nil); err != nil {
+		t.Errorf("DeleteURL failed: %v", err)
+	}
+
+	if _, err := db.UpdateURL(ctx, namedURL{Name: "wiki", URL: "http://en.wikipedia.org", ShouldExpandDates: true}, []string{"other"}); err == nil {
+		t.Errorf("UpdateURL should not update a URL owned by someone else")
+	}
+	if _, err := db.UpdateURL(ctx, namedURL{Name: "missing", URL: "http://en.wikipedia.org", ShouldExpandDates: true}, nil); err == nil {
+		t.Errorf("UpdateURL should fail for a missing URL")
+	}
+	if before, err := db.UpdateURL(ctx, namedURL{Name: "wiki", URL: "http://en.wikipedia.org", ShouldExpandDates: true, Visibility: visibilityPrivate, Allowed: []string{"group:hr"}}, []string{"lascap"}); err != nil {
+		t.Errorf("UpdateURL failed for its owner: %v", err)
+	} else if !reflect.DeepEqual(before, wiki) {
+		t.Errorf("UpdateURL returned %#v, want the previous version %#v", before, wiki)
+	}
+	updatedWiki := namedURL{
+		Name:              "wiki",
+		URL:               "http://en.wikipedia.org",
+		Owners:            []string{"lascap"},
+		ShouldExpandDates: true,
+		Visibility:        visibilityPrivate,
+		Allowed:           []string{"group:hr"},
+	}
+	if got, err := db.LoadURL(ctx, "wiki"); err != nil {
+		t.Errorf("LoadURL failed: %v", err)
+	} else if !reflect.DeepEqual(got, updatedWiki) {
+		t.Errorf("LoadURL after UpdateURL returned %#v, want %#v", got, updatedWiki)
+	}
+
+	if _, err := db.DeleteURL(ctx, "wiki", []string{"other"}); err == nil {
+		t.Errorf("DeleteURL should not delete a URL owned by someone else")
+	}
+	if deleted, err := db.DeleteURL(ctx, "wiki", []string{"lascap"}); err != nil {
+		t.Errorf("DeleteURL failed for its owner: %v", err)
+	} else if !reflect.DeepEqual(deleted, updatedWiki) {
+		t.Errorf("DeleteURL returned %#v, want the deleted version %#v", deleted, updatedWiki)
+	}
+	if _, err := db.LoadURL(ctx, "wiki"); err != (NotFoundError{"wiki"}) {
+		t.Errorf("LoadURL after DeleteURL returned %v, want a NotFoundError", err)
+	}
+	if _, err := db.DeleteURL(ctx, "google", nil); err != nil {
+		t.Errorf("DeleteURL with no user check failed: %v", err)
+	}
+	if _, err := db.DeleteURL(ctx, "google", nil); err == nil {
+		t.Errorf("DeleteURL should fail for a missing URL")
+	}
+
+	if err := db.SaveURL(ctx, namedURL{Name: "platform", URL: "http://example.com/platform", Owners: []string{"group:platform"}}); err != nil {
+		t.Fatalf("SaveURL failed: %v", err)
+	}
+	if _, err := db.UpdateURL(ctx, namedURL{Name: "platform", URL: "http://example.com/infra"}, []string{"lascap", "group:infra"}); err == nil {
+		t.Errorf("UpdateURL should not update a URL owned by another group")
+	}
+	if _, err := db.UpdateURL(ctx, namedURL{Name: "platform", URL: "http://example.com/infra"}, []string{"lascap", "group:platform"}); err != nil {
+		t.Errorf("UpdateURL failed for a member of the owner group: %v", err)
+	}
+	if _, err := db.DeleteURL(ctx, "platform", []string{"lascap", "group:platform"}); err != nil {
+		t.Errorf("DeleteURL failed for a member of the owner group: %v", err)
+	}
+
+	if err := db.SaveURL(ctx, namedURL{Name: "team", URL: "http://example.com/team", Owners: []string{"lascap"}}); err != nil {
+		t.Fatalf("SaveURL failed: %v", err)
+	}
+	if _, err := db.AddOwners(ctx, "team", []string{"john"}, []string{"other"}); err == nil {
+		t.Errorf("AddOwners should not change a URL owned by someone else")
+	}
+	if before, err := db.AddOwners(ctx, "team", []string{"john", "lascap"}, []string{"lascap"}); err != nil {
+		t.Errorf("AddOwners failed: %v", err)
+	} else if !reflect.DeepEqual(before.Owners, []string{"lascap"}) {
+		t.Errorf("AddOwners returned %#v, want the owners before the change", before.Owners)
+	}
+	if _, err := db.RemoveOwners(ctx, "team", []string{"lascap", "john"}, []string{"john"}); err == nil {
+		t.Errorf("RemoveOwners should not remove all the owners")
+	}
+	if _, err := db.RemoveOwners(ctx, "team", []string{"lascap"}, []string{"john"}); err != nil {
+		t.Errorf("RemoveOwners failed: %v", err)
+	}
+	if u, err := db.LoadURL(ctx, "team"); err != nil || !reflect.DeepEqual(u.Owners, []string{"john"}) {
+		t.Errorf("LoadURL after changing owners returned %#v, %v, want it owned by john", u.Owners, err)
+	}
+	if _, err := db.SetOwners(ctx, "team", []string{"group:platform"}, []string{"lascap"}); err == nil {
+		t.Errorf("SetOwners should not change a URL owned by someone else")
+	}
+	if _, err := db.SetOwners(ctx, "team", []string{"group:platform"}, nil); err != nil {
+		t.Errorf("SetOwners with no user check failed: %v", err)
+	}
+	if u, err := db.LoadURL(ctx, "team"); err != nil || !reflect.DeepEqual(u.Owners, []string{"group:platform"}) {
+		t.Errorf("LoadURL after transferring ownership returned %#v, %v, want it owned by group:platform", u.Owners, err)
+	}
+	expiresAt := time.Date(2020, 9, 10, 0, 0, 0, 0, time.UTC)
+	if err := db.SaveURL(ctx, namedURL{Name: "orphan", URL: "http://example.com/orphan", ExpiresAt: &expiresAt}); err != nil {
+		t.Fatalf("SaveURL failed: %v", err)
+	}
+	if _, err := db.UpdateURL(ctx, namedURL{Name: "orphan", URL: "http://example.com/adopted"}, nil); err != nil {
+		t.Errorf("UpdateURL failed: %v", err)
+	}
+	if u, err := db.LoadURL(ctx, "orphan"); err != nil || u.ExpiresAt == nil || !u.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("LoadURL after UpdateURL returned %#v, %v, want it to still expire", u, err)
+	}
+	if _, err := db.AddOwners(ctx, "orphan", []string{"lascap"}, nil); err != nil {
+		t.Errorf("AddOwners failed for a URL without owners: %v", err)
+	}
+	if u, err := db.LoadURL(ctx, "orphan"); err != nil || !reflect.DeepEqual(u.Owners, []string{"lascap"}) || u.ExpiresAt != nil {
+		t.Errorf("LoadURL after adopting a URL returned %#v, %v, want it owned by lascap without expiry", u, err)
+	}
+	if err := db.SaveURL(ctx, namedURL{Name: "shared", URL: "http://example.com/shared", Owners: []string{"lascap", "john"}, ExpiresAt: &expiresAt}); err != nil {
+		t.Fatalf("SaveURL failed: %v", err)
+	}
+	if _, err := db.RemoveOwners(ctx, "shared", []string{"john"}, nil); err != nil {
+		t.Errorf("RemoveOwners failed: %v", err)
+	}
+	if u, err := db.LoadURL(ctx, "shared"); err != nil || !reflect.DeepEqual(u.Owners, []string{"lascap"}) || u.ExpiresAt != nil {
+		t.Errorf("LoadURL after removing an owner returned %#v, %v, want it owned by lascap without expiry", u, err)
+	}
+
+	if revs, err := db.ListRevisions(ctx, "wiki"); err != nil || len(revs) != 0 {
+		t.Errorf("ListRevisions with no revisions returned %v, %v", revs, err)
+	}
+	revs := []revision{
+		{Name: "wiki", User: "lascap", Time: time.Date(2020, 9, 3, 0, 0, 0, 0, time.UTC), Action: "save", After: &wiki},
+		{Name: "google", Time: time.Date(2020, 9, 4, 0, 0, 0, 0, time.UTC), Action: "save"},
+		{Name: "wiki", User: "lascap", Time: time.Date(2020, 9, 5, 0, 0, 0, 0, time.UTC), Action: "update", Before: &wiki, After: &updatedWiki},
+		{Name: "wiki", User: "lascap", Time: time.Date(2020, 9, 6, 0, 0, 0, 0, time.UTC), Action: "delete", Before: &updatedWiki},
+	}
+	for _, rev := range revs {
+		if err := db.SaveRevision(ctx, rev); err != nil {
+			t.Errorf("SaveRevision failed: %v", err)
+		}
+	}
+	want := []revision{revs[0], revs[2], revs[3]}
+	if got, err := db.ListRevisions(ctx, "wiki"); err != nil {
+		t.Errorf("ListRevisions failed: %v", err)
+	} else if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListRevisions returned\n%#v\nwant\n%#v", got, want)
+	}
+}
+
+// testStatsStore checks the behavior shared by all implementations of
+// statsStore. The store must be empty when calling this function.
+func testStatsStore(t *testing.T, store statsStore) {
+	ctx := context.Background()
+
+	if stats, err := store.LoadStats(ctx, []string{"wiki"}); err != nil || len(stats) != 0 {
+		t.Errorf("LoadStats on an empty store returned %v, %v", stats, err)
+	}
+
+	first := time.Date(2020, 9, 3, 10, 0, 0, 0, time.UTC)
+	last := time.Date(2020, 9, 4, 10, 0, 0, 0, time.UTC)
+	if err := store.AddHits(ctx, "wiki", "2020-09-04", 2, last); err != nil {
+		t.Fatalf("AddHits failed: %v", err)
+	}
+	if err := store.AddHits(ctx, "wiki", "2020-09-03", 3, first); err != nil {
+		t.Fatalf("AddHits failed: %v", err)
+	}
+	if err := store.AddHits(ctx, "wiki", "2020-09-04", 1, last); err != nil {
+		t.Fatalf("AddHits failed: %v", err)
+	}
+	if err := store.AddHits(ctx, "google", "2020-09-04", 1, last); err != nil {
+		t.Fatalf("AddHits failed: %v", err)
+	}
+
+	stats, err := store.LoadStats(ctx, []string{"wiki", "missing"})
+	if err != nil {
+		t.Fatalf("LoadStats failed: %v", err)
+	}
+	want := map[string]linkStats{
+		"wiki": {
+			Name:     "wiki",
+			Hits:     6,
+			LastUsed: &last,
+			Daily:    map[string]int{"2020-09-03": 3, "2020-09-04": 3},
+		},
+	}
+	if len(stats) != 1 || stats["wiki"].Hits != 6 || !stats["wiki"].LastUsed.Equal(last) ||
+		!reflect.DeepEqual(stats["wiki"].Daily, want["wiki"].Daily) {
+		t.Errorf("LoadStats returned %#v, want %#v", stats, want)
+	}
+}
+
+func testTokenStore(t *testing.T, store tokenStore) {
+	ctx := context.Background()
+
+	if _, err := store.LoadToken(ctx, hashToken("secret")); err == nil {
+		t.Errorf("LoadToken on an empty store should fail")
+	}
+
+	created := time.Date(2020, 9, 3, 10, 0, 0, 0, time.UTC)
+	tokens := []apiToken{
+		{ID: "ci", Hash: hashToken("secret"), User: "pascal", Name: "CI", Created: created.Add(time.Hour)},
+		{ID: "laptop", Hash: hashToken("other"), User: "pascal", Name: "Laptop", Created: created},
+		{ID: "john", Hash: hashToken("john"), User: "john", Created: created},
+	}
+	for _, token := range tokens {
+		if err := store.SaveToken(ctx, token); err != nil {
+			t.Fatalf("SaveToken failed: %v", err)
+		}
+	}
+
+	loaded, err := store.LoadToken(ctx, hashToken("secret"))
+	if err != nil {
+		t.Fatalf("LoadToken failed: %v", err)
+	}
+	if loaded.ID != "ci" || loaded.User != "pascal" || loaded.Hash != hashToken("secret") || !loaded.Created.Equal(tokens[0].Created) {
+		t.Errorf("LoadToken returned %#v, want %#v", loaded, tokens[0])
+	}
+
+	listed, err := store.ListTokens(ctx, "pascal")
+	if err != nil {
+		t.Fatalf("ListTokens failed: %v", err)
+	}
+	if len(listed) != 2 || listed[0].ID != "laptop" || listed[1].ID != "ci" {
+		t.Errorf("ListTokens returned %#v, want the laptop and CI tokens", listed)
+	}
+
+	if err := store.DeleteToken(ctx, "ci", "john"); err == nil {
+		t.Errorf("DeleteToken of another user's token should fail")
+	}
+	if err := store.DeleteToken(ctx, "ci", "pascal"); err != nil {
+		t.Errorf("DeleteToken failed: %v", err)
+	}
+	if _, err := store.LoadToken(ctx, hashToken("secret")); err == nil {
+		t.Errorf("LoadToken of a deleted token should fail")
+	}
+	if err := store.DeleteToken(ctx, "ci", "pascal"); err == nil {
+		t.Errorf("DeleteToken of a deleted token should fail")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// A deadlineDatabase is a database decorator that gives up on each call after
+// a timeout, so that a hung database does not hold requests forever.
+type deadlineDatabase struct {
+	db      database
+	timeout time.Duration
+}
+
+func (d deadlineDatabase) ListURLs(ctx context.Context, q listQuery) ([]namedURL, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.db.ListURLs(ctx, q)
+}
+
+func (d deadlineDatabase) LoadURL(ctx context.Context, name string) (namedURL, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.db.LoadURL(ctx, name)
+}
+
+func (d deadlineDatabase) SaveURL(ctx context.Context, u namedURL) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.db.SaveURL(ctx, u)
+}
+
+func (d deadlineDatabase) UpdateURL(ctx context.Context, u namedURL, principals []string) (namedURL, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.db.UpdateURL(ctx, u, principals)
+}
+
+func (d deadlineDatabase) DeleteURL(ctx context.Context, name string, principals []string) (namedURL, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.db.DeleteURL(ctx, name, principals)
+}
+
+func (d deadlineDatabase) AddOwners(ctx context.Context, name string, owners []string, principals []string) (namedURL, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.db.AddOwners(ctx, name, owners, principals)
+}
+
+func (d deadlineDatabase) RemoveOwners(ctx context.Context, name string, owners []string, principals []string) (namedURL, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.db.RemoveOwners(ctx, name, owners, principals)
+}
+
+func (d deadlineDatabase) SetOwners(ctx context.Context, name string, owners []string, principals []string) (namedURL, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.db.SetOwners(ctx, name, owners, principals)
+}
+
+func (d deadlineDatabase) SaveRevision(ctx context.Context, rev revision) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.db.SaveRevision(ctx, rev)
+}
+
+func (d deadlineDatabase) ListRevisions(ctx context.Context, name string) ([]revision, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.db.ListRevisions(ctx, name)
+}
+
+func (d deadlineDatabase) SearchURLs(ctx context.Context, query string, limit int) ([]namedURL, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.db.SearchURLs(ctx, query, limit)
+}
+
+func (d deadlineDatabase) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.db.Ping(ctx)
+}
+
+func (d deadlineDatabase) Close(ctx context.Context) error {
+	return d.db.Close(ctx)
+}
+
+// A deadlineAudit is an auditStore decorator that gives up on each call after a
+// timeout.
+type deadlineAudit struct {
+	audit   auditStore
+	timeout time.Duration
+}
+
+func (d deadlineAudit) RecordAudit(ctx context.Context, entry auditEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.audit.RecordAudit(ctx, entry)
+}
+
+func (d deadlineAudit) ListAudit(ctx context.Context, q auditQuery) ([]auditEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.audit.ListAudit(ctx, q)
+}
+
+// A deadlineStats is a statsStore decorator that gives up on each call after a
+// timeout.
+type deadlineStats struct {
+	stats   statsStore
+	timeout time.Duration
+}
+
+func (d deadlineStats) AddHits(ctx context.Context, name string, day string, count int, lastUsed time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.stats.AddHits(ctx, name, day, count, lastUsed)
+}
+
+func (d deadlineStats) LoadStats(ctx context.Context, names []string) (map[string]linkStats, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.stats.LoadStats(ctx, names)
+}
+
+// A deadlineTokens is a tokenStore decorator that gives up on each call after a
+// timeout.
+type deadlineTokens struct {
+	tokens  tokenStore
+	timeout time.Duration
+}
+
+func (d deadlineTokens) SaveToken(ctx context.Context, t apiToken) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.tokens.SaveToken(ctx, t)
+}
+
+func (d deadlineTokens) LoadToken(ctx context.Context, hash string) (apiToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.tokens.LoadToken(ctx, hash)
+}
+
+func (d deadlineTokens) ListTokens(ctx context.Context, user string) ([]apiToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.tokens.ListTokens(ctx, user)
+}
+
+func (d deadlineTokens) DeleteToken(ctx context.Context, id string, user string) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.tokens.DeleteToken(ctx, id, user)
+}
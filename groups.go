@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// forwardedGroupsHeader is the header in which an auth proxy can forward the
+// groups of the user, separated by commas.
+const forwardedGroupsHeader = "X-Forwarded-Groups"
+
+// A groupSource tells which groups a user belongs to. Group names are given
+// without the groupPrefix.
+type groupSource interface {
+	Groups(request *http.Request, user string) []string
+}
+
+// staticGroups are groups listed in a config file, keyed by user.
+type staticGroups map[string][]string
+
+// loadStaticGroups reads groups from a JSON file giving the members of each
+// group, e.g. {"platform": ["pascal@example.com", "john@example.com"]}.
+func loadStaticGroups(path string) (staticGroups, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the groups file: %w", err)
+	}
+	var members map[string][]string
+	if err := json.Unmarshal(data, &members); err != nil {
+		return nil, fmt.Errorf("Could not parse the groups file %q: %w", path, err)
+	}
+	groups := staticGroups{}
+	for group, users := range members {
+		for _, user := range users {
+			groups[user] = append(groups[user], group)
+		}
+	}
+	for _, userGroups := range groups {
+		sort.Strings(userGroups)
+	}
+	return groups, nil
+}
+
+func (g staticGroups) Groups(request *http.Request, user string) []string {
+	return g[user]
+}
+
+// headerGroups are the groups forwarded by the auth proxy in the
+// forwardedGroupsHeader header.
+type headerGroups struct{}
+
+func (headerGroups) Groups(request *http.Request, user string) []string {
+	var groups []string
+	for _, group := range strings.Split(request.Header.Get(forwardedGroupsHeader), ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// viewer returns the principals for whom to check the visibility of URLs: nil
+// for super users, who see everything, and an empty list without a user.
+func (s server) viewer(request *http.Request) []string {
+	user := userFrom(request)
+	if user == "" {
+		return []string{}
+	}
+	if s.SuperUser != nil && s.SuperUser[user] {
+		return nil
+	}
+	return s.principals(request, user)
+}
+
+// principals returns the owners that grant the user the rights on a URL: the
+// user themself and the groups they belong to.
+func (s server) principals(request *http.Request, user string) []string {
+	principals := []string{user}
+	if s.Groups == nil {
+		return principals
+	}
+	for _, group := range s.Groups.Groups(request, user) {
+		principals = append(principals, groupPrefix+group)
+	}
+	return principals
+}
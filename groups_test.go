@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStaticGroups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "groups.json")
+	content := `{"platform": ["pascal@example.com", "john@example.com"], "infra": ["pascal@example.com"]}`
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("test setup error, could not write the groups file: %v", err)
+	}
+
+	groups, err := loadStaticGroups(path)
+	if err != nil {
+		t.Fatalf("loadStaticGroups failed: %v", err)
+	}
+
+	s := server{Groups: groups}
+	request := httptest.NewRequest("GET", "http://go/wiki", nil)
+	tests := []struct {
+		user   string
+		expect []string
+	}{
+		{"pascal@example.com", []string{"pascal@example.com", "group:infra", "group:platform"}},
+		{"john@example.com", []string{"john@example.com", "group:platform"}},
+		{"other@example.com", []string{"other@example.com"}},
+	}
+	for _, test := range tests {
+		if got := s.principals(request, test.user); !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("principals(%q) = %q, want %q", test.user, got, test.expect)
+		}
+	}
+}
+
+func TestHeaderGroups(t *testing.T) {
+	tests := []struct {
+		header string
+		expect []string
+	}{
+		{"platform, infra", []string{"platform", "infra"}},
+		{"platform,,", []string{"platform"}},
+		{"", nil},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", "http://go/wiki", nil)
+		request.Header.Set("X-Forwarded-Groups", test.header)
+		if got := (headerGroups{}).Groups(request, "pascal"); !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("Groups with header %q = %q, want %q", test.header, got, test.expect)
+		}
+	}
+}
@@ -1,36 +1,176 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-type realClock struct {}
+type realClock struct{}
+
 func (realClock) Now() time.Time { return time.Now() }
 
+// newDatabase creates the database selected by the STORAGE env variable.
+func newDatabase() (database, error) {
+	switch storage := os.Getenv("STORAGE"); storage {
+	case "", "mongodb":
+		dbName := os.Getenv("MONGODB_DB_NAME")
+		if dbName == "" {
+			dbName = "url-shortener"
+		}
+		collectionName := os.Getenv("MONGODB_COLLECTION_NAME")
+		if collectionName == "" {
+			collectionName = "shortURL"
+		}
+		historyCollectionName := os.Getenv("MONGODB_HISTORY_COLLECTION_NAME")
+		if historyCollectionName == "" {
+			historyCollectionName = collectionName + "History"
+		}
+		statsCollectionName := os.Getenv("MONGODB_STATS_COLLECTION_NAME")
+		if statsCollectionName == "" {
+			statsCollectionName = collectionName + "Stats"
+		}
+		tokensCollectionName := os.Getenv("MONGODB_TOKENS_COLLECTION_NAME")
+		if tokensCollectionName == "" {
+			tokensCollectionName = collectionName + "Tokens"
+		}
+		auditCollectionName := os.Getenv("MONGODB_AUDIT_COLLECTION_NAME")
+		if auditCollectionName == "" {
+			auditCollectionName = collectionName + "Audit"
+		}
+		return &mongoDatabase{
+			URL:                   os.Getenv("MONGODB_URL"),
+			DBName:                dbName,
+			CollectionName:        collectionName,
+			HistoryCollectionName: historyCollectionName,
+			StatsCollectionName:   statsCollectionName,
+			TokensCollectionName:  tokensCollectionName,
+			AuditCollectionName:   auditCollectionName,
+		}, nil
+	case "memory":
+		return &memoryDatabase{}, nil
+	case "bolt":
+		path := os.Getenv("BOLT_PATH")
+		if path == "" {
+			path = "url-shortener.db"
+		}
+		return newBoltDatabase(path)
+	default:
+		return nil, fmt.Errorf("Unknown storage %q", storage)
+	}
+}
+
 func main() {
-	dbName := os.Getenv("MONGODB_DB_NAME")
-	if dbName == "" {
-		dbName = "url-shortener"
+	db, err := newDatabase()
+	if err != nil {
+		log.Fatal(err)
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	m := newMetrics(reg)
+
+	dbTimeout := durationFromEnv("DB_TIMEOUT", 5*time.Second)
+	var serverDB database = db
+	if dbTimeout > 0 {
+		serverDB = deadlineDatabase{db: db, timeout: dbTimeout}
 	}
-	collectionName := os.Getenv("MONGODB_COLLECTION_NAME")
-	if collectionName == "" {
-		collectionName = "shortURL"
+
+	serverDB = instrumentedDatabase{db: serverDB, metrics: m}
+	if cacheSize := intFromEnv("CACHE_SIZE", 0); cacheSize > 0 {
+		cache := newCachedDatabase(serverDB, cacheSize, durationFromEnv("CACHE_TTL", time.Minute))
+		reg.MustRegister(
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name: "urlshortener_cache_hits_total",
+				Help: "Number of short URLs loaded from the cache.",
+			}, func() float64 { return float64(cache.Hits()) }),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name: "urlshortener_cache_misses_total",
+				Help: "Number of short URLs that were not in the cache.",
+			}, func() float64 { return float64(cache.Misses()) }))
+		serverDB = cache
 	}
+
 	s := &server{
 		ShortURLPrefix: os.Getenv("SHORT_URL_PREFIX"),
-		DB:             &mongoDatabase{
-			URL: os.Getenv("MONGODB_URL"),
-			DBName: dbName,
-			CollectionName: collectionName,
-		},
-		Clock: realClock{},
+		DB:             serverDB,
+		Clock:          realClock{},
+		Metrics:        m,
+	}
+
+	var analytics *asyncAnalytics
+	if os.Getenv("ANALYTICS") != "off" {
+		if stats, ok := db.(statsStore); ok {
+			if dbTimeout > 0 {
+				stats = deadlineStats{stats: stats, timeout: dbTimeout}
+			}
+			analytics = newAsyncAnalytics(stats, 10000, 10*time.Second)
+			reg.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name: "urlshortener_analytics_dropped_hits_total",
+				Help: "Number of hits dropped because they arrived faster than they could be aggregated.",
+			}, func() float64 { return float64(analytics.Dropped()) }))
+			s.Stats = stats
+			s.Analytics = analytics
+		}
+	}
+
+	if tokens, ok := db.(tokenStore); ok {
+		if dbTimeout > 0 {
+			tokens = deadlineTokens{tokens: tokens, timeout: dbTimeout}
+		}
+		s.Tokens = tokens
+	}
+
+	switch auditLog := os.Getenv("AUDIT_LOG"); auditLog {
+	case "", "off":
+	case "file":
+		path := os.Getenv("AUDIT_FILE")
+		if path == "" {
+			path = "audit.jsonl"
+		}
+		s.Audit = &fileAudit{path: path}
+	case "db":
+		audit, ok := db.(auditStore)
+		if !ok {
+			log.Fatal("The storage does not support the audit trail, use AUDIT_LOG=file instead")
+		}
+		if dbTimeout > 0 {
+			audit = deadlineAudit{audit: audit, timeout: dbTimeout}
+		}
+		s.Audit = audit
+	default:
+		log.Fatalf("Invalid AUDIT_LOG %q, want off, file or db", auditLog)
+	}
+
+	if groupsFile := os.Getenv("GROUPS_FILE"); groupsFile != "" {
+		groups, err := loadStaticGroups(groupsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.Groups = groups
+	} else if os.Getenv("FORWARDED_GROUPS") == "on" {
+		s.Groups = headerGroups{}
+	}
+
+	switch policy := anonymousPolicy(os.Getenv("ANONYMOUS_LINKS")); policy {
+	case "", anonymousAllow:
+	case anonymousDeny, anonymousExpire:
+		s.AnonymousLinks = policy
+		s.AnonymousLinksTTL = durationFromEnv("ANONYMOUS_LINKS_TTL", 7*24*time.Hour)
+	default:
+		log.Fatalf("Invalid ANONYMOUS_LINKS policy %q, want allow, deny or expire", policy)
 	}
 
 	if superUsers := strings.TrimSpace(os.Getenv("SUPER_USERS")); superUsers != "" {
@@ -40,11 +180,52 @@ func main() {
 		}
 	}
 
+	var auth *oidcAuth
+	if issuer := os.Getenv("OIDC_ISSUER_URL"); issuer != "" {
+		config := oidcConfig{
+			IssuerURL:     issuer,
+			ClientID:      os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:   os.Getenv("OIDC_REDIRECT_URL"),
+			SessionSecret: []byte(os.Getenv("SESSION_SECRET")),
+			SessionTTL:    durationFromEnv("SESSION_TTL", 24*time.Hour),
+		}
+		if domains := strings.TrimSpace(os.Getenv("OIDC_ALLOWED_DOMAINS")); domains != "" {
+			for _, domain := range strings.Split(domains, ",") {
+				config.AllowedDomains = append(config.AllowedDomains, strings.TrimSpace(domain))
+			}
+		}
+		if auth, err = newOIDCAuth(context.Background(), config); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	r := mux.NewRouter()
-	r.HandleFunc("/"+internalPagesPrefix+"/list", s.List).Methods("POST")
-	r.HandleFunc("/"+internalPagesPrefix+"/save", s.Save).Methods("POST")
-	r.HandleFunc("/"+internalPagesPrefix+"/{name}", s.Delete).Methods("DELETE")
-	r.HandleFunc("/{name}{folder:(?:/.*)?}", s.Load)
+	if auth != nil {
+		r.HandleFunc("/"+internalPagesPrefix+"/login", auth.Login).Methods("GET")
+		r.HandleFunc("/"+internalPagesPrefix+"/oauth2/callback", auth.Callback).Methods("GET")
+		r.HandleFunc("/"+internalPagesPrefix+"/logout", auth.Logout).Methods("GET", "POST")
+	}
+	r.HandleFunc("/"+internalPagesPrefix+"/healthz", s.Healthz).Methods("GET")
+	r.HandleFunc("/"+internalPagesPrefix+"/readyz", s.Readyz).Methods("GET")
+	r.Handle("/"+internalPagesPrefix+"/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{})).Methods("GET")
+	r.Handle("/"+internalPagesPrefix+"/list", m.instrument("List", s.List)).Methods("POST")
+	r.Handle("/"+internalPagesPrefix+"/save", m.instrument("Save", s.Save)).Methods("POST")
+	r.Handle("/"+internalPagesPrefix+"/search", m.instrument("Search", s.Search)).Methods("GET")
+	r.Handle("/"+internalPagesPrefix+"/audit", m.instrument("ListAudit", s.ListAudit)).Methods("GET")
+	r.Handle("/"+internalPagesPrefix+"/tokens", m.instrument("ListTokens", s.ListTokens)).Methods("GET")
+	r.Handle("/"+internalPagesPrefix+"/tokens", m.instrument("CreateToken", s.CreateToken)).Methods("POST")
+	r.Handle("/"+internalPagesPrefix+"/tokens/{id}", m.instrument("RevokeToken", s.RevokeToken)).Methods("DELETE")
+	r.Handle("/"+internalPagesPrefix+"/{name}/history", m.instrument("History", s.History)).Methods("GET")
+	r.Handle("/"+internalPagesPrefix+"/{name}/stats", m.instrument("LinkStats", s.LinkStats)).Methods("GET")
+	r.Handle("/"+internalPagesPrefix+"/{name}/claim", m.instrument("Claim", s.Claim)).Methods("POST")
+	r.Handle("/"+internalPagesPrefix+"/{name}/owners", m.instrument("AddOwner", s.AddOwner)).Methods("POST")
+	r.Handle("/"+internalPagesPrefix+"/{name}/owners", m.instrument("TransferOwnership", s.TransferOwnership)).Methods("PUT")
+	r.Handle("/"+internalPagesPrefix+"/{name}/owners/{owner}", m.instrument("RemoveOwner", s.RemoveOwner)).Methods("DELETE")
+	r.Handle("/"+internalPagesPrefix+"/{name}/revert", m.instrument("Revert", s.Revert)).Methods("POST")
+	r.Handle("/"+internalPagesPrefix+"/{name}", m.instrument("Update", s.Update)).Methods("PUT")
+	r.Handle("/"+internalPagesPrefix+"/{name}", m.instrument("Delete", s.Delete)).Methods("DELETE")
+	r.Handle("/{name}{folder:(?:/.*)?}", m.instrument("Load", s.Load))
 	r.HandleFunc("/", func(response http.ResponseWriter, request *http.Request) {
 		http.ServeFile(response, request, "public/index.html")
 	})
@@ -54,5 +235,102 @@ func main() {
 		port = envPort
 	}
 
-	log.Fatal(http.ListenAndServe(":"+port, handlers.LoggingHandler(os.Stdout, r)))
+	var handler http.Handler = r
+	if auth != nil {
+		handler = auth.requireLogin(r,
+			"/"+internalPagesPrefix+"/login",
+			"/"+internalPagesPrefix+"/oauth2/callback",
+			"/"+internalPagesPrefix+"/healthz",
+			"/"+internalPagesPrefix+"/readyz",
+			"/"+internalPagesPrefix+"/metrics")
+	}
+	if s.Tokens != nil {
+		handler = s.authenticateTokens(handler)
+	}
+
+	proxies := strings.TrimSpace(os.Getenv("TRUSTED_PROXIES"))
+	proxySecret := os.Getenv("PROXY_SECRET")
+	if proxies != "" || proxySecret != "" {
+		var networks []string
+		if proxies != "" {
+			for _, network := range strings.Split(proxies, ",") {
+				networks = append(networks, strings.TrimSpace(network))
+			}
+		}
+		secretHeader := os.Getenv("PROXY_SECRET_HEADER")
+		if secretHeader == "" {
+			secretHeader = "X-Proxy-Secret"
+		}
+		proxy, err := newTrustedProxy(networks, secretHeader, proxySecret)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler = proxy.middleware(handler)
+	}
+
+	srv := &http.Server{
+		Addr:         ":" + port,
+		Handler:      handlers.LoggingHandler(os.Stdout, handler),
+		ReadTimeout:  durationFromEnv("READ_TIMEOUT", 10*time.Second),
+		WriteTimeout: durationFromEnv("WRITE_TIMEOUT", 30*time.Second),
+		IdleTimeout:  durationFromEnv("IDLE_TIMEOUT", 2*time.Minute),
+	}
+	shutdownTimeout := durationFromEnv("SHUTDOWN_TIMEOUT", 30*time.Second)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case sig := <-stop:
+		log.Printf("Received %v, shutting down...", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Could not drain all the connections: %v", err)
+	}
+	if analytics != nil {
+		analytics.Close()
+	}
+	// The shutdown context may have expired while draining the connections.
+	closeCtx, cancelClose := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelClose()
+	if err := db.Close(closeCtx); err != nil {
+		log.Printf("Could not close the database: %v", err)
+	}
+}
+
+// durationFromEnv parses a duration such as "10s" from an env variable, or
+// returns the default value if the variable is not set.
+func durationFromEnv(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid duration for %s: %v", name, err)
+	}
+	return d
+}
+
+// intFromEnv parses an integer from an env variable, or returns the default
+// value if the variable is not set.
+func intFromEnv(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid integer for %s: %v", name, err)
+	}
+	return i
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics are the Prometheus metrics exported by the server.
+type metrics struct {
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	redirects       *prometheus.CounterVec
+	dbDuration      *prometheus.HistogramVec
+	dbErrors        *prometheus.CounterVec
+}
+
+// newMetrics creates the metrics and registers them.
+func newMetrics(reg prometheus.Registerer) *metrics {
+	m := &metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "urlshortener_http_requests_total",
+			Help: "Number of HTTP requests by handler and status code.",
+		}, []string{"handler", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "urlshortener_http_request_duration_seconds",
+			Help:    "Latency of HTTP requests by handler.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"handler"}),
+		redirects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "urlshortener_redirects_total",
+			Help: "Number of short URLs followed by outcome: found, not_found or error.",
+		}, []string{"outcome"}),
+		dbDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "urlshortener_database_duration_seconds",
+			Help:    "Latency of database calls by operation.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"operation"}),
+		dbErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "urlshortener_database_errors_total",
+			Help: "Number of failed database calls by operation, not counting missing or already existing URLs.",
+		}, []string{"operation"}),
+	}
+	reg.MustRegister(m.requests, m.requestDuration, m.redirects, m.dbDuration, m.dbErrors)
+	return m
+}
+
+// instrument wraps a handler to count its requests and measure their latency.
+func (m *metrics) instrument(handler string, h http.HandlerFunc) http.Handler {
+	labels := prometheus.Labels{"handler": handler}
+	return promhttp.InstrumentHandlerCounter(
+		m.requests.MustCurryWith(labels),
+		promhttp.InstrumentHandlerDuration(m.requestDuration.MustCurryWith(labels), h))
+}
+
+// countRedirect counts a short URL that was followed. It accepts a nil
+// receiver so that the server can run without metrics.
+func (m *metrics) countRedirect(outcome string) {
+	if m == nil {
+		return
+	}
+	m.redirects.WithLabelValues(outcome).Inc()
+}
+
+// observeDB records the latency and the failure of a database call started at
+// the given time.
+func (m *metrics) observeDB(operation string, start time.Time, err error) {
+	m.dbDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err == nil {
+		return
+	}
+	switch err.(type) {
+	case NotFoundError, AlreadyExistsError:
+		return
+	}
+	m.dbErrors.WithLabelValues(operation).Inc()
+}
+
+// An instrumentedDatabase is a database decorator that measures the latency of
+// each call.
+type instrumentedDatabase struct {
+	db      database
+	metrics *metrics
+}
+
+func (d instrumentedDatabase) ListURLs(ctx context.Context, q listQuery) (urls []namedURL, next string, err error) {
+	defer func(start time.Time) { d.metrics.observeDB("ListURLs", start, err) }(time.Now())
+	return d.db.ListURLs(ctx, q)
+}
+
+func (d instrumentedDatabase) LoadURL(ctx context.Context, name string) (u namedURL, err error) {
+	defer func(start time.Time) { d.metrics.observeDB("LoadURL", start, err) }(time.Now())
+	return d.db.LoadURL(ctx, name)
+}
+
+func (d instrumentedDatabase) SaveURL(ctx context.Context, u namedURL) (err error) {
+	defer func(start time.Time) { d.metrics.observeDB("SaveURL", start, err) }(time.Now())
+	return d.db.SaveURL(ctx, u)
+}
+
+func (d instrumentedDatabase) UpdateURL(ctx context.Context, u namedURL, principals []string) (before namedURL, err error) {
+	defer func(start time.Time) { d.metrics.observeDB("UpdateURL", start, err) }(time.Now())
+	return d.db.UpdateURL(ctx, u, principals)
+}
+
+func (d instrumentedDatabase) DeleteURL(ctx context.Context, name string, principals []string) (deleted namedURL, err error) {
+	defer func(start time.Time) { d.metrics.observeDB("DeleteURL", start, err) }(time.Now())
+	return d.db.DeleteURL(ctx, name, principals)
+}
+
+func (d instrumentedDatabase) AddOwners(ctx context.Context, name string, owners []string, principals []string) (before namedURL, err error) {
+	defer func(start time.Time) { d.metrics.observeDB("AddOwners", start, err) }(time.Now())
+	return d.db.AddOwners(ctx, name, owners, principals)
+}
+
+func (d instrumentedDatabase) RemoveOwners(ctx context.Context, name string, owners []string, principals []string) (before namedURL, err error) {
+	defer func(start time.Time) { d.metrics.observeDB("RemoveOwners", start, err) }(time.Now())
+	return d.db.RemoveOwners(ctx, name, owners, principals)
+}
+
+func (d instrumentedDatabase) SetOwners(ctx context.Context, name string, owners []string, principals []string) (before namedURL, err error) {
+	defer func(start time.Time) { d.metrics.observeDB("SetOwners", start, err) }(time.Now())
+	return d.db.SetOwners(ctx, name, owners, principals)
+}
+
+func (d instrumentedDatabase) SaveRevision(ctx context.Context, rev revision) (err error) {
+	defer func(start time.Time) { d.metrics.observeDB("SaveRevision", start, err) }(time.Now())
+	return d.db.SaveRevision(ctx, rev)
+}
+
+func (d instrumentedDatabase) ListRevisions(ctx context.Context, name string) (revs []revision, err error) {
+	defer func(start time.Time) { d.metrics.observeDB("ListRevisions", start, err) }(time.Now())
+	return d.db.ListRevisions(ctx, name)
+}
+
+func (d instrumentedDatabase) SearchURLs(ctx context.Context, query string, limit int) (urls []namedURL, err error) {
+	defer func(start time.Time) { d.metrics.observeDB("SearchURLs", start, err) }(time.Now())
+	return d.db.SearchURLs(ctx, query, limit)
+}
+
+func (d instrumentedDatabase) Ping(ctx context.Context) (err error) {
+	defer func(start time.Time) { d.metrics.observeDB("Ping", start, err) }(time.Now())
+	return d.db.Ping(ctx)
+}
+
+func (d instrumentedDatabase) Close(ctx context.Context) error {
+	return d.db.Close(ctx)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gatheredValue returns the value of a counter, or the number of observations
+// of a histogram, that has the given label value.
+func gatheredValue(t *testing.T, reg *prometheus.Registry, name string, labelValue string) float64 {
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Could not gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if !hasLabelValue(metric, labelValue) {
+				continue
+			}
+			if c := metric.GetCounter(); c != nil {
+				return c.GetValue()
+			}
+			return float64(metric.GetHistogram().GetSampleCount())
+		}
+	}
+	return 0
+}
+
+func hasLabelValue(metric *dto.Metric, value string) bool {
+	for _, label := range metric.GetLabel() {
+		if label.GetValue() == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := newMetrics(reg)
+	db := &memoryDatabase{}
+	if err := db.SaveURL(context.Background(), namedURL{Name: "wiki", URL: "http://github.com/bayesimpact/wiki"}); err != nil {
+		t.Fatalf("test setup error, could not save: %v", err)
+	}
+	s := &server{Clock: realClock{}, DB: instrumentedDatabase{db: db, metrics: m}, Metrics: m}
+
+	r := mux.NewRouter()
+	r.Handle("/{name}{folder:(?:/.*)?}", m.instrument("Load", s.Load))
+
+	for _, url := range []string{"http://go/wiki", "http://go/wiki/Home", "http://go/wikki"} {
+		request, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatalf("test setup error, impossible to create request: %v", err)
+		}
+		r.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	if got, want := gatheredValue(t, reg, "urlshortener_redirects_total", "found"), 2.; got != want {
+		t.Errorf("Counted %v found redirects, want %v", got, want)
+	}
+	if got, want := gatheredValue(t, reg, "urlshortener_redirects_total", "not_found"), 1.; got != want {
+		t.Errorf("Counted %v not found redirects, want %v", got, want)
+	}
+	if got, want := gatheredValue(t, reg, "urlshortener_http_request_duration_seconds", "Load"), 3.; got != want {
+		t.Errorf("Measured %v Load requests, want %v", got, want)
+	}
+	if got, want := gatheredValue(t, reg, "urlshortener_database_duration_seconds", "LoadURL"), 3.; got != want {
+		t.Errorf("Measured %v LoadURL calls, want %v", got, want)
+	}
+	if got := gatheredValue(t, reg, "urlshortener_database_errors_total", "LoadURL"); got != 0 {
+		t.Errorf("Counted %v LoadURL errors, want none as a missing URL is not an error", got)
+	}
+}
+
+func TestInstrumentedDatabaseErrors(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := newMetrics(reg)
+	db := instrumentedDatabase{
+		db: stubDB{
+			loadURL: func(name string) (namedURL, error) {
+				return namedURL{}, errors.New("Could not connect to DB")
+			},
+		},
+		metrics: m,
+	}
+
+	if _, err := db.LoadURL(context.Background(), "wiki"); err == nil {
+		t.Errorf("LoadURL should forward the error")
+	}
+
+	if got, want := gatheredValue(t, reg, "urlshortener_database_errors_total", "LoadURL"), 1.; got != want {
+		t.Errorf("Counted %v LoadURL errors, want %v", got, want)
+	}
+}
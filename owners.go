@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ownersEditor returns the user of a request and the principals that must own
+// a URL for them to change its owners, nil for super users. It writes an error
+// and returns an empty user if there's no user.
+func (s server) ownersEditor(response http.ResponseWriter, request *http.Request) (string, []string) {
+	user := userFrom(request)
+	if user == "" {
+		http.Error(response, `{"error":"Request with no user"}`, http.StatusUnauthorized)
+		return "", nil
+	}
+	if s.SuperUser != nil && s.SuperUser[user] {
+		return user, nil
+	}
+	return user, s.principals(request, user)
+}
+
+// writeOwners records the change of owners and responds with the new owners.
+func (s server) writeOwners(request *http.Request, response http.ResponseWriter, user string, before namedURL, owners []string) {
+	// Changing the owners also stops the URL from expiring.
+	after := copyNamedURL(before)
+	after.Owners = owners
+	after.ExpiresAt = nil
+	s.recordRevision(request, before.Name, user, "owners", &before, &after)
+
+	if jsonData, ok := marshalJson(response, map[string]interface{}{"name": before.Name, "owners": owners}); ok {
+		response.Write(jsonData)
+	}
+}
+
+// AddOwner adds a co-owner to a short URL.
+func (s server) AddOwner(response http.ResponseWriter, request *http.Request) {
+	user, principals := s.ownersEditor(response, request)
+	if user == "" {
+		return
+	}
+	name := mux.Vars(request)["name"]
+
+	var data struct {
+		Owner string `json:"owner"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&data); err != nil {
+		http.Error(response, `{"error":"Unable to parse json"}`, http.StatusBadRequest)
+		return
+	}
+	if data.Owner = strings.TrimSpace(data.Owner); data.Owner == "" {
+		http.Error(response, `{"error":"Missing owner"}`, http.StatusBadRequest)
+		return
+	}
+
+	before, err := s.DB.AddOwners(request.Context(), name, []string{data.Owner}, principals)
+	if err != nil {
+		writeDBError(response, err)
+		return
+	}
+	s.writeOwners(request, response, user, before, addOwners(before.Owners, []string{data.Owner}))
+}
+
+// RemoveOwner removes an owner from a short URL. The last owner cannot be
+// removed: ownership should be transferred instead.
+func (s server) RemoveOwner(response http.ResponseWriter, request *http.Request) {
+	user, principals := s.ownersEditor(response, request)
+	if user == "" {
+		return
+	}
+	vars := mux.Vars(request)
+	name := vars["name"]
+	removed := []string{vars["owner"]}
+
+	if current, err := s.DB.LoadURL(request.Context(), name); err == nil && isOwnedBy(current, principals) {
+		if len(removeOwners(current.Owners, removed)) == 0 {
+			if jsonData, ok := marshalJson(response, map[string]string{"error": fmt.Sprintf("Cannot remove the last owner of %q", name)}); ok {
+				http.Error(response, string(jsonData), http.StatusBadRequest)
+			}
+			return
+		}
+	}
+
+	before, err := s.DB.RemoveOwners(request.Context(), name, removed, principals)
+	if err != nil {
+		writeDBError(response, err)
+		return
+	}
+	s.writeOwners(request, response, user, before, removeOwners(before.Owners, removed))
+}
+
+// Claim lets a super user become the owner of a short URL that has none, e.g.
+// one created without a user, so that it does not expire.
+func (s server) Claim(response http.ResponseWriter, request *http.Request) {
+	user := userFrom(request)
+	if user == "" {
+		http.Error(response, `{"error":"Request with no user"}`, http.StatusUnauthorized)
+		return
+	}
+	if s.SuperUser == nil || !s.SuperUser[user] {
+		http.Error(response, `{"error":"Only super users can claim links"}`, http.StatusForbidden)
+		return
+	}
+	name := mux.Vars(request)["name"]
+
+	current, err := s.DB.LoadURL(request.Context(), name)
+	if err != nil {
+		if _, ok := err.(NotFoundError); ok {
+			http.Error(response, `{"error":"No such URL"}`, http.StatusNotFound)
+			return
+		}
+		writeDBError(response, err)
+		return
+	}
+	if len(current.Owners) > 0 {
+		if jsonData, ok := marshalJson(response, map[string]string{"error": fmt.Sprintf("%q already has owners", name)}); ok {
+			http.Error(response, string(jsonData), http.StatusConflict)
+		}
+		return
+	}
+
+	before, err := s.DB.SetOwners(request.Context(), name, []string{user}, nil)
+	if err != nil {
+		writeDBError(response, err)
+		return
+	}
+	s.writeOwners(request, response, user, before, []string{user})
+}
+
+// TransferOwnership replaces all the owners of a short URL.
+func (s server) TransferOwnership(response http.ResponseWriter, request *http.Request) {
+	user, principals := s.ownersEditor(response, request)
+	if user == "" {
+		return
+	}
+	name := mux.Vars(request)["name"]
+
+	var data struct {
+		Owners []string `json:"owners"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&data); err != nil {
+		http.Error(response, `{"error":"Unable to parse json"}`, http.StatusBadRequest)
+		return
+	}
+	var owners []string
+	for _, owner := range data.Owners {
+		if owner = strings.TrimSpace(owner); owner != "" {
+			owners = addOwners(owners, []string{owner})
+		}
+	}
+	if len(owners) == 0 {
+		http.Error(response, `{"error":"Missing owners"}`, http.StatusBadRequest)
+		return
+	}
+
+	before, err := s.DB.SetOwners(request.Context(), name, owners, principals)
+	if err != nil {
+		writeDBError(response, err)
+		return
+	}
+	s.writeOwners(request, response, user, before, owners)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestOwners(t *testing.T) {
+	tests := []struct {
+		desc            string
+		method          string
+		request         string
+		body            string
+		forwardedUser   string
+		forwardedGroups string
+		expectCode      int
+		expectBody      string
+		expectOwners    []string
+	}{
+		{
+			desc:          "Add a co-owner",
+			method:        "POST",
+			request:       "/wiki/owners",
+			body:          `{"owner":"john"}`,
+			forwardedUser: "lascap",
+			expectCode:    http.StatusOK,
+			expectBody:    `{"name":"wiki","owners":["lascap","john"]}`,
+			expectOwners:  []string{"lascap", "john"},
+		},
+		{
+			desc:          "Add an existing owner",
+			method:        "POST",
+			request:       "/wiki/owners",
+			body:          `{"owner":"lascap"}`,
+			forwardedUser: "lascap",
+			expectCode:    http.StatusOK,
+			expectBody:    `{"name":"wiki","owners":["lascap"]}`,
+			expectOwners:  []string{"lascap"},
+		},
+		{
+			desc:          "Add a co-owner without owner",
+			method:        "POST",
+			request:       "/wiki/owners",
+			body:          `{"owner":" "}`,
+			forwardedUser: "lascap",
+			expectCode:    http.StatusBadRequest,
+			expectBody:    `{"error":"Missing owner"}` + "\n",
+			expectOwners:  []string{"lascap"},
+		},
+		{
+			desc:          "Add a co-owner to a URL owned by someone else",
+			method:        "POST",
+			request:       "/wiki/owners",
+			body:          `{"owner":"john"}`,
+			forwardedUser: "john",
+			expectCode:    http.StatusInternalServerError,
+			expectBody:    `{"error":"The short URL does not exist: \"wiki\""}` + "\n",
+			expectOwners:  []string{"lascap"},
+		},
+		{
+			desc:         "Missing user",
+			method:       "POST",
+			request:      "/wiki/owners",
+			body:         `{"owner":"john"}`,
+			expectCode:   http.StatusUnauthorized,
+			expectBody:   `{"error":"Request with no user"}` + "\n",
+			expectOwners: []string{"lascap"},
+		},
+		{
+			desc:          "Remove the last owner",
+			method:        "DELETE",
+			request:       "/wiki/owners/lascap",
+			forwardedUser: "lascap",
+			expectCode:    http.StatusBadRequest,
+			expectBody:    `{"error":"Cannot remove the last owner of \"wiki\""}` + "\n",
+			expectOwners:  []string{"lascap"},
+		},
+		{
+			desc:          "Super user removes the last owner",
+			method:        "DELETE",
+			request:       "/wiki/owners/lascap",
+			forwardedUser: "SUPER USER",
+			expectCode:    http.StatusBadRequest,
+			expectBody:    `{"error":"Cannot remove the last owner of \"wiki\""}` + "\n",
+			expectOwners:  []string{"lascap"},
+		},
+		{
+			desc:          "Transfer ownership",
+			method:        "PUT",
+			request:       "/wiki/owners",
+			body:          `{"owners":["group:platform", "john", "john"]}`,
+			forwardedUser: "lascap",
+			expectCode:    http.StatusOK,
+			expectBody:    `{"name":"wiki","owners":["group:platform","john"]}`,
+			expectOwners:  []string{"group:platform", "john"},
+		},
+		{
+			desc:          "Transfer ownership to nobody",
+			method:        "PUT",
+			request:       "/wiki/owners",
+			body:          `{"owners":[]}`,
+			forwardedUser: "lascap",
+			expectCode:    http.StatusBadRequest,
+			expectBody:    `{"error":"Missing owners"}` + "\n",
+			expectOwners:  []string{"lascap"},
+		},
+		{
+			desc:          "Super user transfers ownership",
+			method:        "PUT",
+			request:       "/wiki/owners",
+			body:          `{"owners":["john"]}`,
+			forwardedUser: "SUPER USER",
+			expectCode:    http.StatusOK,
+			expectBody:    `{"name":"wiki","owners":["john"]}`,
+			expectOwners:  []string{"john"},
+		},
+	}
+
+	for _, test := range tests {
+		db := &memoryDatabase{}
+		if err := db.SaveURL(context.Background(), namedURL{Name: "wiki", URL: "http://en.wikipedia.org", Owners: []string{"lascap"}}); err != nil {
+			t.Fatalf("%s: test setup error, impossible to save URL: %v", test.desc, err)
+		}
+		s := &server{
+			DB:        db,
+			SuperUser: map[string]bool{"SUPER USER": true},
+			Clock:     realClock{},
+			Groups:    headerGroups{},
+		}
+
+		r := mux.NewRouter()
+		r.HandleFunc("/{name}/owners", s.AddOwner).Methods("POST")
+		r.HandleFunc("/{name}/owners", s.TransferOwnership).Methods("PUT")
+		r.HandleFunc("/{name}/owners/{owner}", s.RemoveOwner).Methods("DELETE")
+
+		response := httptest.NewRecorder()
+		request := httptest.NewRequest(test.method, "http://go"+test.request, strings.NewReader(test.body))
+		if test.forwardedUser != "" {
+			request.Header.Set("X-Forwarded-User", test.forwardedUser)
+		}
+		if test.forwardedGroups != "" {
+			request.Header.Set("X-Forwarded-Groups", test.forwardedGroups)
+		}
+
+		r.ServeHTTP(response, request)
+
+		if got, want := response.Code, test.expectCode; got != want {
+			t.Errorf("%s: had response code %d, want %d\n%v", test.desc, got, want, response)
+			continue
+		}
+
+		if got, want := response.Body.String(), test.expectBody; got != want {
+			t.Errorf("%s: returned a body with %q, want %q", test.desc, got, want)
+		}
+
+		if u, err := db.LoadURL(context.Background(), "wiki"); err != nil || !reflect.DeepEqual(u.Owners, test.expectOwners) {
+			t.Errorf("%s: the URL is owned by %q, %v, want %q", test.desc, u.Owners, err, test.expectOwners)
+		}
+	}
+}
+
+func TestRemoveOwnerFromGroup(t *testing.T) {
+	db := &memoryDatabase{}
+	ctx := context.Background()
+	if err := db.SaveURL(ctx, namedURL{Name: "wiki", URL: "http://en.wikipedia.org", Owners: []string{"lascap", "group:platform"}}); err != nil {
+		t.Fatalf("SaveURL failed: %v", err)
+	}
+	s := &server{DB: db, Clock: realClock{}, Groups: headerGroups{}}
+	r := mux.NewRouter()
+	r.HandleFunc("/{name}/owners/{owner}", s.RemoveOwner).Methods("DELETE")
+
+	response := httptest.NewRecorder()
+	request := httptest.NewRequest("DELETE", "http://go/wiki/owners/lascap", nil)
+	request.Header.Set("X-Forwarded-User", "john")
+	request.Header.Set("X-Forwarded-Groups", "platform")
+	r.ServeHTTP(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("A member of an owner group removing an owner had response code %d, want %d\n%v", response.Code, http.StatusOK, response)
+	}
+	if revs, err := db.ListRevisions(ctx, "wiki"); err != nil || len(revs) != 1 || revs[0].Action != "owners" || revs[0].User != "john" {
+		t.Errorf("Removing an owner recorded the revisions %#v, %v, want one owners revision by john", revs, err)
+	}
+}
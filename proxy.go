@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// A trustedProxy checks that the requests come through the auth proxy before
+// trusting the user it forwards in the X-Forwarded-User header. The proxy is
+// recognized by its network address, by a secret header it adds to each
+// request, or both if both are configured.
+type trustedProxy struct {
+	networks     []*net.IPNet
+	secretHeader string
+	secret       string
+}
+
+// newTrustedProxy creates a trustedProxy accepting requests from the given
+// networks (in CIDR notation or single IPs) and carrying the secret in the
+// secretHeader header. Either networks or secret may be empty to skip the
+// check.
+func newTrustedProxy(networks []string, secretHeader string, secret string) (*trustedProxy, error) {
+	p := &trustedProxy{secretHeader: secretHeader, secret: secret}
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, fmt.Errorf("Not a valid proxy IP: %q", network)
+			}
+			if ip.To4() != nil {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("Not a valid proxy network: %q", network)
+		}
+		p.networks = append(p.networks, ipNet)
+	}
+	return p, nil
+}
+
+// isTrusted returns whether a request comes from the proxy.
+func (p *trustedProxy) isTrusted(request *http.Request) bool {
+	if p.secret != "" {
+		got := request.Header.Get(p.secretHeader)
+		if subtle.ConstantTimeCompare([]byte(got), []byte(p.secret)) != 1 {
+			return false
+		}
+	}
+	if len(p.networks) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range p.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// middleware wraps a handler so that it ignores the X-Forwarded-User and
+// X-Forwarded-Groups headers of requests that do not come from the proxy. The
+// secret header is removed so that it does not leak further. For requests from
+// the proxy, the client IP is the last one the proxy added to X-Forwarded-For.
+func (p *trustedProxy) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if !p.isTrusted(request) {
+			request.Header.Del("X-Forwarded-User")
+			request.Header.Del(forwardedGroupsHeader)
+		} else if forwardedFor := request.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+			ips := strings.Split(forwardedFor, ",")
+			request = request.WithContext(withClientIP(request.Context(), strings.TrimSpace(ips[len(ips)-1])))
+		}
+		if p.secretHeader != "" {
+			request.Header.Del(p.secretHeader)
+		}
+		next.ServeHTTP(response, request)
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedProxy(t *testing.T) {
+	tests := []struct {
+		desc         string
+		networks     []string
+		secret       string
+		remoteAddr   string
+		secretHeader string
+		expectUser   string
+	}{
+		{
+			desc:       "From trusted network",
+			networks:   []string{"10.0.0.0/8"},
+			remoteAddr: "10.1.2.3:4567",
+			expectUser: "pascal",
+		},
+		{
+			desc:       "From trusted IP",
+			networks:   []string{"192.168.0.1", "::1"},
+			remoteAddr: "[::1]:4567",
+			expectUser: "pascal",
+		},
+		{
+			desc:       "From untrusted network",
+			networks:   []string{"10.0.0.0/8"},
+			remoteAddr: "192.168.0.1:4567",
+		},
+		{
+			desc:         "With secret",
+			secret:       "s3cr3t",
+			remoteAddr:   "192.168.0.1:4567",
+			secretHeader: "s3cr3t",
+			expectUser:   "pascal",
+		},
+		{
+			desc:         "With wrong secret",
+			secret:       "s3cr3t",
+			remoteAddr:   "192.168.0.1:4567",
+			secretHeader: "guess",
+		},
+		{
+			desc:       "Without secret",
+			secret:     "s3cr3t",
+			remoteAddr: "192.168.0.1:4567",
+		},
+		{
+			desc:         "With secret from untrusted network",
+			networks:     []string{"10.0.0.0/8"},
+			secret:       "s3cr3t",
+			remoteAddr:   "192.168.0.1:4567",
+			secretHeader: "s3cr3t",
+		},
+	}
+
+	for _, test := range tests {
+		p, err := newTrustedProxy(test.networks, "X-Proxy-Secret", test.secret)
+		if err != nil {
+			t.Errorf("%s: newTrustedProxy failed: %v", test.desc, err)
+			continue
+		}
+		var user, leakedSecret string
+		handler := p.middleware(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			user = userFrom(request)
+			leakedSecret = request.Header.Get("X-Proxy-Secret")
+		}))
+
+		request := httptest.NewRequest("GET", "http://go/wiki", nil)
+		request.RemoteAddr = test.remoteAddr
+		request.Header.Set("X-Forwarded-User", "pascal")
+		if test.secretHeader != "" {
+			request.Header.Set("X-Proxy-Secret", test.secretHeader)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+
+		if user != test.expectUser {
+			t.Errorf("%s: the handler got user %q, want %q", test.desc, user, test.expectUser)
+		}
+		if leakedSecret != "" {
+			t.Errorf("%s: the handler got the proxy secret", test.desc)
+		}
+	}
+}
+
+func TestNewTrustedProxyInvalidNetwork(t *testing.T) {
+	for _, network := range []string{"10.0.0.0/33", "not-an-ip", ""} {
+		if _, err := newTrustedProxy([]string{network}, "", ""); err == nil {
+			t.Errorf("newTrustedProxy(%q) should fail", network)
+		}
+	}
+}
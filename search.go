@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// searchTerms splits a free text search query into lower case terms.
+func searchTerms(query string) []string {
+	return strings.Fields(strings.ToLower(query))
+}
+
+// searchScore rates how well a URL matches all the search terms: a match in
+// the name is worth more than one in the target URL, itself worth more than
+// one in the description. It returns 0 if any of the terms does not match.
+func searchScore(u namedURL, terms []string) int {
+	name := strings.ToLower(u.Name)
+	target := strings.ToLower(u.URL)
+	description := strings.ToLower(u.Description)
+
+	score := 0
+	for _, term := range terms {
+		termScore := 0
+		switch {
+		case name == term:
+			termScore += 10
+		case strings.HasPrefix(name, term):
+			termScore += 6
+		case strings.Contains(name, term):
+			termScore += 4
+		}
+		if strings.Contains(target, term) {
+			termScore += 2
+		}
+		if strings.Contains(description, term) {
+			termScore++
+		}
+		if termScore == 0 {
+			return 0
+		}
+		score += termScore
+	}
+	return score
+}
+
+// rankURLs keeps the URLs matching all the search terms and sorts them from
+// the best match. At most limit URLs are returned.
+func rankURLs(urls []namedURL, terms []string, limit int) []namedURL {
+	type scoredURL struct {
+		url   namedURL
+		score int
+	}
+	var scored []scoredURL
+	for _, u := range urls {
+		if score := searchScore(u, terms); score > 0 {
+			scored = append(scored, scoredURL{u, score})
+		}
+	}
+	sort.Slice(scored, func(i, j int) bool {
+		if scored[i].score != scored[j].score {
+			return scored[i].score > scored[j].score
+		}
+		return scored[i].url.Name < scored[j].url.Name
+	})
+	if len(scored) > limit {
+		scored = scored[:limit]
+	}
+
+	var ranked []namedURL
+	for _, s := range scored {
+		ranked = append(ranked, s.url)
+	}
+	return ranked
+}
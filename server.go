@@ -4,8 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -22,6 +24,19 @@ type Clock interface {
 	Now() time.Time
 }
 
+// An anonymousPolicy tells what happens to links created without a user.
+type anonymousPolicy string
+
+const (
+	// anonymousAllow lets anyone create links that nobody owns.
+	anonymousAllow anonymousPolicy = "allow"
+	// anonymousDeny rejects the creation of links without a user.
+	anonymousDeny anonymousPolicy = "deny"
+	// anonymousExpire lets anyone create links that expire unless a super user
+	// claims them.
+	anonymousExpire anonymousPolicy = "expire"
+)
+
 type server struct {
 	// ShortURLPrefix is an optional prefix to return even shorter URLs than
 	// using the request's hostname and path.
@@ -34,6 +49,33 @@ type server struct {
 	SuperUser map[string]bool
 
 	Clock Clock
+
+	// Analytics receives the hits of short URLs if set.
+	Analytics analyticsSink
+
+	// Stats gives access to the aggregated hits of short URLs if set.
+	Stats statsStore
+
+	// Metrics are updated with the outcome of redirects if set.
+	Metrics *metrics
+
+	// Tokens stores the API tokens if set.
+	Tokens tokenStore
+
+	// Groups tells which groups users belong to, so that they can act on the
+	// URLs owned by these groups, if set.
+	Groups groupSource
+
+	// AnonymousLinks is the policy for links created without a user. Defaults
+	// to anonymousAllow.
+	AnonymousLinks anonymousPolicy
+
+	// AnonymousLinksTTL is how long links created without a user last with the
+	// anonymousExpire policy.
+	AnonymousLinksTTL time.Duration
+
+	// Audit keeps the audit trail of all changes if set.
+	Audit auditSink
 }
 
 // illegalChars is a string containing all characters that are illegal in short
@@ -76,24 +118,68 @@ func (s server) Save(response http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if _, err := neturl.Parse(data.URL); err != nil {
+	if err := validateKind(data); err != nil {
+		if jsonData, ok := marshalJson(response, map[string]string{"error": err.Error()}); ok {
+			http.Error(response, string(jsonData), http.StatusBadRequest)
+		}
+		return
+	}
+
+	if _, err := neturl.Parse(sampleURL(data)); err != nil {
 		if jsonData, ok := marshalJson(response, map[string]string{"error": fmt.Sprintf("Not a valid URL: %q.", data.URL)}); ok {
 			http.Error(response, string(jsonData), http.StatusBadRequest)
 		}
 		return
 	}
 
-	if user := userFrom(request); user != "" {
+	if !isValidVisibility(data.Visibility) {
+		if jsonData, ok := marshalJson(response, map[string]string{"error": fmt.Sprintf("Not a valid visibility: %q", data.Visibility)}); ok {
+			http.Error(response, string(jsonData), http.StatusBadRequest)
+		}
+		return
+	}
+	if data.Visibility == visibilityPublic {
+		data.Visibility = ""
+	}
+
+	user := userFrom(request)
+	data.ExpiresAt = nil
+	if user != "" {
 		data.Owners = []string{user}
+	} else {
+		data.Owners = nil
+		switch s.AnonymousLinks {
+		case anonymousDeny:
+			http.Error(response, `{"error":"Log in to create a link"}`, http.StatusUnauthorized)
+			return
+		case anonymousExpire:
+			expiresAt := s.Clock.Now().Add(s.AnonymousLinksTTL)
+			data.ExpiresAt = &expiresAt
+		}
 	}
 
-	if err := s.DB.SaveURL(context.TODO(), data.Name, data.URL, data.Owners, data.ShouldExpandDates); err != nil {
-		if jsonData, ok := marshalJson(response, map[string]string{"error": err.Error()}); ok {
-			http.Error(response, string(jsonData), http.StatusInternalServerError)
+	err := s.DB.SaveURL(request.Context(), data)
+	if _, ok := err.(AlreadyExistsError); ok && s.dropExpiredURL(request, data.Name) {
+		err = s.DB.SaveURL(request.Context(), data)
+	}
+	if err != nil {
+		if _, ok := err.(AlreadyExistsError); ok {
+			reply := map[string]interface{}{"error": fmt.Sprintf("The name %q is already taken", data.Name)}
+			if existing, err := s.DB.LoadURL(request.Context(), data.Name); err == nil && isListedFor(existing, s.viewer(request)) {
+				reply["existing"] = existing
+			}
+			if jsonData, ok := marshalJson(response, reply); ok {
+				http.Error(response, string(jsonData), http.StatusConflict)
+			}
+			return
 		}
+
+		writeDBError(response, err)
 		return
 	}
 
+	s.recordRevision(request, data.Name, user, "save", nil, &data)
+
 	resp := map[string]string{"name": data.Name}
 	if s.ShortURLPrefix != "" {
 		resp["url"] = s.ShortURLPrefix
@@ -106,28 +192,88 @@ func (s server) Save(response http.ResponseWriter, request *http.Request) {
 func (s server) Load(response http.ResponseWriter, request *http.Request) {
 	name := mux.Vars(request)["name"]
 
-	loaded, err := s.DB.LoadURL(context.TODO(), name)
+	loaded, err := s.DB.LoadURL(request.Context(), name)
+	if err == nil && (isExpired(loaded, s.Clock.Now()) || !canFollow(loaded, s.viewer(request))) {
+		err = NotFoundError{name}
+	}
 	if err != nil {
 		if _, ok := err.(NotFoundError); ok {
 			q := neturl.Values{}
 			q.Add("name", name)
 			q.Add("error", "No such URL yet. Feel free to add one.")
+			// Suggestions are only a nice to have: ignore failures.
+			if suggestions, err := s.suggestNames(request.Context(), name, userFrom(request), s.viewer(request)); err == nil {
+				for _, suggestion := range suggestions {
+					q.Add("suggestion", suggestion)
+				}
+			}
+			s.Metrics.countRedirect("not_found")
 			http.Redirect(response, request, "/#/?"+q.Encode(), http.StatusFound)
 			return
 		}
 
-		if jsonData, ok := marshalJson(response, map[string]string{"error": err.Error()}); ok {
-			http.Error(response, string(jsonData), http.StatusInternalServerError)
-		}
+		s.Metrics.countRedirect("error")
+		writeDBError(response, err)
 		return
 	}
+
 	url := loaded.URL
 	statusCode := http.StatusMovedPermanently
-	if loaded.ShouldExpandDates {
+	folder := mux.Vars(request)["folder"]
+	forwardQuery := true
+	// found is false when a template misses arguments and falls back.
+	found := true
+	if loaded.Kind == templateKind {
+		params := request.URL.Query()
+		// The route matches the unescaped path, so the arguments are taken from
+		// the escaped one, after the first segment which is the name.
+		escapedFolder := ""
+		if escapedPath := request.URL.EscapedPath(); len(escapedPath) > 1 {
+			if i := strings.Index(escapedPath[1:], "/"); i >= 0 {
+				escapedFolder = escapedPath[i+1:]
+			}
+		}
+		expanded, used, ok := expandTemplate(loaded.URL, templateArgs(escapedFolder), params)
+		if !ok {
+			if loaded.FallbackURL == "" {
+				s.Metrics.countRedirect("not_found")
+				q := neturl.Values{}
+				q.Add("error", fmt.Sprintf("Missing arguments for %q: %s", name, loaded.URL))
+				http.Redirect(response, request, "/#/?"+q.Encode(), http.StatusFound)
+				return
+			}
+			expanded = loaded.FallbackURL
+			found = false
+		}
+		// The parameters used to fill the template are not forwarded, the other
+		// ones are merged in the query of the target.
+		for _, param := range used {
+			params.Del(param)
+		}
+		url = mergeQuery(expanded, params)
+		// The path was used to fill the template.
+		folder = ""
+		forwardQuery = false
+		statusCode = http.StatusFound
+	} else if loaded.ShouldExpandDates {
 		url = s.Clock.Now().Format(url)
 		statusCode = http.StatusFound
 	}
 
+	if !found {
+		s.Metrics.countRedirect("not_found")
+	} else {
+		s.Metrics.countRedirect("found")
+		if s.Analytics != nil {
+			s.Analytics.Record(hit{
+				Time:    s.Clock.Now(),
+				Name:    name,
+				Referer: request.Referer(),
+				User:    userFrom(request),
+			})
+		}
+	}
+
 	var u *neturl.URL
 	if u, err = neturl.Parse(url); err != nil {
 		http.Redirect(response, request, url, statusCode)
@@ -136,12 +282,12 @@ func (s server) Load(response http.ResponseWriter, request *http.Request) {
 
 	var tinkered bool
 
-	if folder := mux.Vars(request)["folder"]; folder != "" {
+	if folder != "" {
 		u.Path = path.Join(u.Path, folder)
 		tinkered = true
 	}
 
-	if q := request.URL.RawQuery; q != "" && u.RawQuery == "" {
+	if q := request.URL.RawQuery; forwardQuery && q != "" && u.RawQuery == "" {
 		u.RawQuery = q
 		tinkered = true
 	}
@@ -153,23 +299,65 @@ func (s server) Load(response http.ResponseWriter, request *http.Request) {
 	http.Redirect(response, request, url, statusCode)
 }
 
+// dropExpiredURL deletes a URL if it has expired, so that its name can be used
+// again. It returns whether the URL was deleted.
+func (s server) dropExpiredURL(request *http.Request, name string) bool {
+	ctx := request.Context()
+	existing, err := s.DB.LoadURL(ctx, name)
+	if err != nil || !isExpired(existing, s.Clock.Now()) {
+		return false
+	}
+	if _, err := s.DB.DeleteURL(ctx, name, nil); err != nil {
+		log.Printf("Could not delete the expired URL %q: %v", name, err)
+		return false
+	}
+	s.recordRevision(request, name, "", "delete", &existing, nil)
+	return true
+}
+
+// List lists a page of short URLs. The page is selected with the query
+// parameters "cursor" (the "nextCursor" returned by the previous page) and
+// "pageSize", and filtered with "owner", "prefix" and "domain".
 func (s server) List(response http.ResponseWriter, request *http.Request) {
-	urls, err := s.DB.ListURLs(context.TODO())
-	if err != nil {
-		if jsonData, ok := marshalJson(response, map[string]string{"error": err.Error()}); ok {
-			http.Error(response, string(jsonData), http.StatusInternalServerError)
+	params := request.URL.Query()
+	q := listQuery{
+		After:      params.Get("cursor"),
+		Owner:      params.Get("owner"),
+		NamePrefix: params.Get("prefix"),
+		Domain:     params.Get("domain"),
+	}
+	if pageSize := params.Get("pageSize"); pageSize != "" {
+		var err error
+		if q.Limit, err = strconv.Atoi(pageSize); err != nil || q.Limit <= 0 {
+			if jsonData, ok := marshalJson(response, map[string]string{"error": fmt.Sprintf("Not a valid page size: %q", pageSize)}); ok {
+				http.Error(response, string(jsonData), http.StatusBadRequest)
+			}
+			return
 		}
-		return
 	}
 
-	if len(urls) == 0 {
-		urls = []namedURL{}
+	urls, next, err := s.DB.ListURLs(request.Context(), q)
+	if err != nil {
+		writeDBError(response, err)
+		return
 	}
+	// The page may end up shorter than requested, but nextCursor still
+	// points after the hidden URLs.
+	urls = listedFor(urls, s.viewer(request), s.Clock.Now())
 
 	result := map[string]interface{}{"urls": urls}
+	if s.Stats != nil {
+		result["urls"] = s.addStats(request.Context(), urls)
+	}
+	if next != "" {
+		result["nextCursor"] = next
+	}
 
 	if user := userFrom(request); user != "" {
 		result["user"] = user
+		if principals := s.principals(request, user); len(principals) > 1 {
+			result["groups"] = principals[1:]
+		}
 
 		if s.SuperUser != nil && s.SuperUser[user] {
 			result["superUser"] = true
@@ -181,26 +369,415 @@ func (s server) List(response http.ResponseWriter, request *http.Request) {
 	}
 }
 
+// A listedURL is a short URL with its usage stats.
+type listedURL struct {
+	namedURL
+	Hits     int        `json:"hits"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+}
+
+// addStats adds the usage stats to a list of URLs. Stats are only a nice to
+// have: if they cannot be loaded, the URLs are returned without them.
+func (s server) addStats(ctx context.Context, urls []namedURL) []listedURL {
+	names := make([]string, len(urls))
+	for i, u := range urls {
+		names[i] = u.Name
+	}
+	stats, err := s.Stats.LoadStats(ctx, names)
+	if err != nil {
+		log.Printf("Could not load stats: %v", err)
+	}
+
+	listed := make([]listedURL, len(urls))
+	for i, u := range urls {
+		listed[i] = listedURL{namedURL: u}
+		if st, ok := stats[u.Name]; ok {
+			listed[i].Hits = st.Hits
+			listed[i].LastUsed = st.LastUsed
+		}
+	}
+	return listed
+}
+
+func (s server) LinkStats(response http.ResponseWriter, request *http.Request) {
+	if s.Stats == nil {
+		http.Error(response, `{"error":"Analytics are disabled"}`, http.StatusNotFound)
+		return
+	}
+
+	name := mux.Vars(request)["name"]
+
+	visible, err := s.canFollowName(request.Context(), name, s.viewer(request))
+	if err != nil {
+		writeDBError(response, err)
+		return
+	}
+	if !visible {
+		http.Error(response, `{"error":"No such URL"}`, http.StatusNotFound)
+		return
+	}
+
+	stats, err := s.Stats.LoadStats(request.Context(), []string{name})
+	if err != nil {
+		writeDBError(response, err)
+		return
+	}
+
+	result, ok := stats[name]
+	if !ok {
+		result = linkStats{Name: name}
+	}
+	if jsonData, ok := marshalJson(response, result); ok {
+		response.Write(jsonData)
+	}
+}
+
+// defaultSearchLimit is the number of results returned by Search if no limit
+// is given.
+const defaultSearchLimit = 20
+
+// Search finds the short URLs best matching the query parameter "q". The
+// number of results can be set with the "limit" query parameter.
+func (s server) Search(response http.ResponseWriter, request *http.Request) {
+	params := request.URL.Query()
+	query := strings.TrimSpace(params.Get("q"))
+	if query == "" {
+		http.Error(response, `{"error":"Missing query"}`, http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultSearchLimit
+	if l := params.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 || limit > maxListedURLs {
+			if jsonData, ok := marshalJson(response, map[string]string{"error": fmt.Sprintf("Not a valid limit: %q", l)}); ok {
+				http.Error(response, string(jsonData), http.StatusBadRequest)
+			}
+			return
+		}
+	}
+
+	// Hidden URLs are filtered out after the search, so ask for more results
+	// until there are enough listed ones or no more to find.
+	viewer := s.viewer(request)
+	var urls []namedURL
+	for fetched := limit; ; fetched *= 2 {
+		if fetched > maxListedURLs {
+			fetched = maxListedURLs
+		}
+		found, err := s.DB.SearchURLs(request.Context(), query, fetched)
+		if err != nil {
+			writeDBError(response, err)
+			return
+		}
+		urls = listedFor(found, viewer, s.Clock.Now())
+		if len(urls) >= limit || len(found) < fetched || fetched == maxListedURLs {
+			break
+		}
+	}
+	if len(urls) > limit {
+		urls = urls[:limit]
+	}
+
+	if jsonData, ok := marshalJson(response, map[string]interface{}{"urls": urls}); ok {
+		response.Write(jsonData)
+	}
+}
+
 func (s server) Delete(response http.ResponseWriter, request *http.Request) {
 	user := userFrom(request)
 	if user == "" {
 		http.Error(response, `{"error":"Request with no user"}`, http.StatusUnauthorized)
 		return
 	}
+	owners := s.principals(request, user)
+	if s.SuperUser != nil && s.SuperUser[user] {
+		owners = nil
+	}
+
+	name := mux.Vars(request)["name"]
+
+	deleted, err := s.DB.DeleteURL(request.Context(), name, owners)
+	if err != nil {
+		writeDBError(response, err)
+		return
+	}
+
+	s.recordRevision(request, name, user, "delete", &deleted, nil)
+
+	response.Write([]byte(`{"success":true}`))
+}
+
+func (s server) Update(response http.ResponseWriter, request *http.Request) {
+	user := userFrom(request)
+	if user == "" {
+		http.Error(response, `{"error":"Request with no user"}`, http.StatusUnauthorized)
+		return
+	}
+	owners := s.principals(request, user)
 	if s.SuperUser != nil && s.SuperUser[user] {
-		user = ""
+		owners = nil
 	}
 
 	name := mux.Vars(request)["name"]
 
-	if err := s.DB.DeleteURL(context.TODO(), name, user); err != nil {
+	decoder := json.NewDecoder(request.Body)
+	var body struct {
+		namedURL
+		// Visibility and Allowed keep their current value if they are left
+		// out, so that only updating the target does not make a private URL
+		// public.
+		Visibility *string   `json:"visibility"`
+		Allowed    *[]string `json:"allowed"`
+	}
+	if err := decoder.Decode(&body); err != nil {
+		http.Error(response, `{"error":"Unable to parse json"}`, http.StatusBadRequest)
+		return
+	}
+	data := body.namedURL
+
+	if data.URL == "" {
+		if jsonData, ok := marshalJson(response, map[string]string{"error": fmt.Sprintf("Missing URL for %q", name)}); ok {
+			http.Error(response, string(jsonData), http.StatusBadRequest)
+		}
+		return
+	}
+
+	if err := validateKind(data); err != nil {
 		if jsonData, ok := marshalJson(response, map[string]string{"error": err.Error()}); ok {
-			http.Error(response, string(jsonData), http.StatusInternalServerError)
+			http.Error(response, string(jsonData), http.StatusBadRequest)
+		}
+		return
+	}
+
+	if _, err := neturl.Parse(sampleURL(data)); err != nil {
+		if jsonData, ok := marshalJson(response, map[string]string{"error": fmt.Sprintf("Not a valid URL: %q.", data.URL)}); ok {
+			http.Error(response, string(jsonData), http.StatusBadRequest)
+		}
+		return
+	}
+
+	if body.Visibility == nil || body.Allowed == nil {
+		current, err := s.DB.LoadURL(request.Context(), name)
+		if err != nil {
+			writeDBError(response, err)
 			return
 		}
+		data.Visibility, data.Allowed = current.Visibility, current.Allowed
+	}
+	if body.Visibility != nil {
+		data.Visibility = *body.Visibility
+	}
+	if body.Allowed != nil {
+		data.Allowed = *body.Allowed
 	}
 
-	response.Write([]byte(`{"success":true}`))
+	if !isValidVisibility(data.Visibility) {
+		if jsonData, ok := marshalJson(response, map[string]string{"error": fmt.Sprintf("Not a valid visibility: %q", data.Visibility)}); ok {
+			http.Error(response, string(jsonData), http.StatusBadRequest)
+		}
+		return
+	}
+	if data.Visibility == visibilityPublic {
+		data.Visibility = ""
+	}
+
+	data.Name = name
+	before, err := s.DB.UpdateURL(request.Context(), data, owners)
+	if err != nil {
+		writeDBError(response, err)
+		return
+	}
+
+	// The owners and the expiry are not changed by an update.
+	after := data
+	after.Owners = before.Owners
+	after.ExpiresAt = before.ExpiresAt
+	s.recordRevision(request, name, user, "update", &before, &after)
+
+	resp := map[string]string{"name": name}
+	if s.ShortURLPrefix != "" {
+		resp["url"] = s.ShortURLPrefix
+	}
+	if jsonData, ok := marshalJson(response, resp); ok {
+		response.Write(jsonData)
+	}
+}
+
+func (s server) History(response http.ResponseWriter, request *http.Request) {
+	name := mux.Vars(request)["name"]
+
+	visible, err := s.canFollowName(request.Context(), name, s.viewer(request))
+	if err != nil {
+		writeDBError(response, err)
+		return
+	}
+	if !visible {
+		http.Error(response, `{"error":"No such URL"}`, http.StatusNotFound)
+		return
+	}
+
+	revs, err := s.DB.ListRevisions(request.Context(), name)
+	if err != nil {
+		writeDBError(response, err)
+		return
+	}
+
+	if len(revs) == 0 {
+		revs = []revision{}
+	}
+
+	if jsonData, ok := marshalJson(response, map[string]interface{}{"revisions": revs}); ok {
+		response.Write(jsonData)
+	}
+}
+
+// Revert restores a short URL as it was right after one of its revisions. The
+// revision is given by its index in the list returned by History.
+func (s server) Revert(response http.ResponseWriter, request *http.Request) {
+	user := userFrom(request)
+	if user == "" {
+		http.Error(response, `{"error":"Request with no user"}`, http.StatusUnauthorized)
+		return
+	}
+	isSuperUser := s.SuperUser != nil && s.SuperUser[user]
+	owners := s.principals(request, user)
+	if isSuperUser {
+		owners = nil
+	}
+
+	name := mux.Vars(request)["name"]
+
+	decoder := json.NewDecoder(request.Body)
+	var data struct {
+		Revision int `json:"revision"`
+	}
+	if err := decoder.Decode(&data); err != nil {
+		http.Error(response, `{"error":"Unable to parse json"}`, http.StatusBadRequest)
+		return
+	}
+
+	revs, err := s.DB.ListRevisions(request.Context(), name)
+	if err != nil {
+		writeDBError(response, err)
+		return
+	}
+	if data.Revision < 0 || data.Revision >= len(revs) {
+		if jsonData, ok := marshalJson(response, map[string]string{"error": fmt.Sprintf("No revision %d for %q", data.Revision, name)}); ok {
+			http.Error(response, string(jsonData), http.StatusNotFound)
+		}
+		return
+	}
+	target := revs[data.Revision].After
+	if target == nil {
+		if jsonData, ok := marshalJson(response, map[string]string{"error": fmt.Sprintf("Revision %d of %q is a deletion", data.Revision, name)}); ok {
+			http.Error(response, string(jsonData), http.StatusBadRequest)
+		}
+		return
+	}
+
+	if _, err := s.DB.LoadURL(request.Context(), name); err != nil {
+		if _, ok := err.(NotFoundError); !ok {
+			writeDBError(response, err)
+			return
+		}
+
+		// The short URL was deleted: restore it with the owners it had. Owned
+		// URLs never expire, whatever older revisions recorded.
+		if !isOwnedBy(*target, owners) {
+			http.Error(response, `{"error":"Only the owners of this revision may restore it"}`, http.StatusForbidden)
+			return
+		}
+		restored := copyNamedURL(*target)
+		if len(restored.Owners) > 0 {
+			restored.ExpiresAt = nil
+		}
+		if err := s.DB.SaveURL(request.Context(), restored); err != nil {
+			writeDBError(response, err)
+			return
+		}
+		s.recordRevision(request, name, user, "revert", nil, &restored)
+	} else {
+		before, err := s.DB.UpdateURL(request.Context(), *target, owners)
+		if err != nil {
+			writeDBError(response, err)
+			return
+		}
+		after := *target
+		after.Owners = before.Owners
+		after.ExpiresAt = before.ExpiresAt
+		s.recordRevision(request, name, user, "revert", &before, &after)
+	}
+
+	resp := map[string]string{"name": name}
+	if s.ShortURLPrefix != "" {
+		resp["url"] = s.ShortURLPrefix
+	}
+	if jsonData, ok := marshalJson(response, resp); ok {
+		response.Write(jsonData)
+	}
+}
+
+// recordRevision records a change made to a short URL in its history and in
+// the audit trail. Failures are only logged: the change was already made.
+func (s server) recordRevision(request *http.Request, name string, user string, action string, before *namedURL, after *namedURL) {
+	rev := revision{
+		Name:   name,
+		User:   user,
+		Time:   s.Clock.Now(),
+		Action: action,
+		Before: before,
+		After:  after,
+	}
+	if err := s.DB.SaveRevision(request.Context(), rev); err != nil {
+		log.Printf("Could not record the %s of %q: %v", action, name, err)
+	}
+	s.audit(request, name, user, action, before, after)
+}
+
+// Healthz tells whether the server is alive. It does not check its
+// dependencies: see Readyz for this.
+func (s server) Healthz(response http.ResponseWriter, request *http.Request) {
+	response.Write([]byte(`{"status":"ok"}`))
+}
+
+// readyzTimeout is the maximum time to wait for the database in Readyz.
+const readyzTimeout = 2 * time.Second
+
+// Readyz tells whether the server is ready to serve requests, that is whether
+// it can reach its database.
+func (s server) Readyz(response http.ResponseWriter, request *http.Request) {
+	ctx, cancel := context.WithTimeout(request.Context(), readyzTimeout)
+	defer cancel()
+
+	if err := s.DB.Ping(ctx); err != nil {
+		if jsonData, ok := marshalJson(response, map[string]string{"error": err.Error()}); ok {
+			http.Error(response, string(jsonData), http.StatusServiceUnavailable)
+		}
+		return
+	}
+
+	response.Write([]byte(`{"status":"ok"}`))
+}
+
+// writeDBError replies with the error of a failed database call: 504 if it
+// timed out, 503 if the database could not be reached and 500 otherwise.
+func writeDBError(response http.ResponseWriter, err error) {
+	reply := map[string]string{"error": err.Error()}
+	code := http.StatusInternalServerError
+	switch {
+	case isTimeout(err):
+		log.Printf("Database timeout: %v", err)
+		reply["error"] = "The database took too long to answer"
+		code = http.StatusGatewayTimeout
+	case isUnavailable(err):
+		log.Printf("Database unavailable: %v", err)
+		reply["error"] = "The database is unavailable"
+		code = http.StatusServiceUnavailable
+	}
+	if jsonData, ok := marshalJson(response, reply); ok {
+		http.Error(response, string(jsonData), code)
+	}
 }
 
 func marshalJson(response http.ResponseWriter, reply interface{}) ([]byte, bool) {
@@ -212,6 +789,20 @@ func marshalJson(response http.ResponseWriter, reply interface{}) ([]byte, bool)
 	return jsonData, true
 }
 
+// userKey is the key of the request context value holding the user, when it
+// was authenticated by the server itself.
+type userKey struct{}
+
+// withUser returns a context holding the authenticated user.
+func withUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// userFrom returns the user making a request: the one authenticated by the
+// server if any, or else the one forwarded by an auth proxy.
 func userFrom(request *http.Request) string {
+	if user, ok := request.Context().Value(userKey{}).(string); ok {
+		return user
+	}
 	return request.Header.Get("X-Forwarded-User")
 }
@@ -13,18 +13,43 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
-type fakeClock struct { now time.Time }
+type fakeClock struct{ now time.Time }
+
 func (f fakeClock) Now() time.Time { return f.now }
 
+// serveRequest sends a request with a body and headers to a handler and
+// returns the response. Headers with an empty value are not set.
+func serveRequest(handler http.Handler, method, target, body string, headers map[string]string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	for key, value := range headers {
+		if value != "" {
+			request.Header.Set(key, value)
+		}
+	}
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	return response
+}
+
+// serveAs sends a request to a handler on behalf of a user, as forwarded by an
+// auth proxy, and returns the response. No user is forwarded if it is empty.
+func serveAs(handler http.Handler, method, target, body, user string) *httptest.ResponseRecorder {
+	return serveRequest(handler, method, target, body, map[string]string{"X-Forwarded-User": user})
+}
+
 func TestServerList(t *testing.T) {
 	tests := []struct {
 		desc                string
+		request             string
 		listURLs            []namedURL
+		listURLsNext        string
 		listURLsError       error
 		forwardedUser       string
 		expectListURLsCalls int
+		expectQuery         listQuery
 		expectCode          int
 		expectBody          string
 	}{
@@ -77,26 +102,58 @@ func TestServerList(t *testing.T) {
 			expectBody:          `{"superUser":true,"urls":[],"user":"SUPER USER"}`,
 			expectListURLsCalls: 1,
 		},
+		{
+			desc:    "Page and filters",
+			request: "?cursor=google&pageSize=1&owner=lascap&prefix=w&domain=github.com",
+			listURLs: []namedURL{
+				{
+					Name:   "wiki",
+					URL:    "http://github.com/bayesimpact/wiki",
+					Owners: []string{"lascap"},
+				},
+			},
+			listURLsNext: "wiki",
+			expectCode:   http.StatusOK,
+			expectBody: `{"nextCursor":"wiki","urls":[` +
+				`{"name":"wiki","url":"http://github.com/bayesimpact/wiki","owners":["lascap"],"shouldExpandDates":false}` +
+				`]}`,
+			expectListURLsCalls: 1,
+			expectQuery: listQuery{
+				After:      "google",
+				Limit:      1,
+				Owner:      "lascap",
+				NamePrefix: "w",
+				Domain:     "github.com",
+			},
+		},
+		{
+			desc:       "Invalid page size",
+			request:    "?pageSize=many",
+			expectCode: http.StatusBadRequest,
+			expectBody: `{"error":"Not a valid page size: \"many\""}` + "\n",
+		},
 	}
 
 	for _, test := range tests {
 		listURLsCalls := 0
+		var query listQuery
 		s := &server{
 			DB: &stubDB{
-				listURLs: func() ([]namedURL, error) {
+				listURLs: func(q listQuery) ([]namedURL, string, error) {
 					listURLsCalls += 1
-					return test.listURLs, test.listURLsError
+					query = q
+					return test.listURLs, test.listURLsNext, test.listURLsError
 				},
 			},
 			SuperUser: map[string]bool{"SUPER USER": true},
-			Clock: realClock{},
+			Clock:     realClock{},
 		}
 
 		r := mux.NewRouter()
 		r.HandleFunc("/list", s.List).Methods("POST")
 
 		response := httptest.NewRecorder()
-		request, err := http.NewRequest("POST", "http://go/list", nil)
+		request, err := http.NewRequest("POST", "http://go/list"+test.request, nil)
 		if err != nil {
 			t.Errorf("%s: test setup error, impossible to create request: %v", test.desc, err)
 			continue
@@ -118,6 +175,10 @@ func TestServerList(t *testing.T) {
 		if got, want := listURLsCalls, test.expectListURLsCalls; got != want {
 			t.Errorf("%s: s.List(...) did %d call(s) to db.ListURLs, want %d", test.desc, got, want)
 		}
+
+		if got, want := query, test.expectQuery; got != want {
+			t.Errorf("%s: s.List(...) called db.ListURLs with %#v, want %#v", test.desc, got, want)
+		}
 	}
 }
 
@@ -211,7 +272,7 @@ func TestServerLoad(t *testing.T) {
 			expectLoadedNames: []string{"okr"},
 			expectCode:        http.StatusFound,
 			// The test is meant to be run on fake date "2020-09-03".
-			expectRedirect:    "/okr-2020-09",
+			expectRedirect: "/okr-2020-09",
 		},
 	}
 
@@ -261,11 +322,183 @@ func TestServerLoad(t *testing.T) {
 	}
 }
 
+func TestLoadSuggestions(t *testing.T) {
+	db := &memoryDatabase{}
+	for _, u := range []namedURL{
+		{Name: "wiki", URL: "http://github.com/bayesimpact/wiki"},
+		{Name: "wikipedia", URL: "http://en.wikipedia.org"},
+		{Name: "okr", URL: "http://okr"},
+		{Name: "roadmap", URL: "http://roadmap", Owners: []string{"lascap"}},
+		{Name: "jira", URL: "http://jira"},
+	} {
+		if err := db.SaveURL(context.Background(), u); err != nil {
+			t.Fatalf("test setup error, could not save %q: %v", u.Name, err)
+		}
+	}
+	s := &server{Clock: realClock{}, DB: db}
+
+	tests := []struct {
+		desc           string
+		request        string
+		forwardedUser  string
+		expectRedirect string
+	}{
+		{
+			desc:           "Typo",
+			request:        "http://go/wikki",
+			expectRedirect: "/#/?error=No+such+URL+yet.+Feel+free+to+add+one.&name=wikki&suggestion=wiki&suggestion=wikipedia",
+		},
+		{
+			desc:           "Prefix",
+			request:        "http://go/wikip",
+			expectRedirect: "/#/?error=No+such+URL+yet.+Feel+free+to+add+one.&name=wikip&suggestion=wiki&suggestion=wikipedia",
+		},
+		{
+			desc:           "Far from others",
+			request:        "http://go/rodmpa",
+			expectRedirect: "/#/?error=No+such+URL+yet.+Feel+free+to+add+one.&name=rodmpa",
+		},
+		{
+			desc:           "Owned link",
+			request:        "http://go/rodmpa",
+			forwardedUser:  "lascap",
+			expectRedirect: "/#/?error=No+such+URL+yet.+Feel+free+to+add+one.&name=rodmpa&suggestion=roadmap",
+		},
+		{
+			desc:           "Nothing close",
+			request:        "http://go/calendar",
+			expectRedirect: "/#/?error=No+such+URL+yet.+Feel+free+to+add+one.&name=calendar",
+		},
+	}
+
+	for _, test := range tests {
+		r := mux.NewRouter()
+		r.HandleFunc("/{name}{folder:(?:/.*)?}", s.Load)
+
+		response := httptest.NewRecorder()
+		request, err := http.NewRequest("GET", test.request, nil)
+		if err != nil {
+			t.Errorf("%s: test setup error, impossible to create request: %v", test.desc, err)
+			continue
+		}
+		if test.forwardedUser != "" {
+			request.Header.Set("X-Forwarded-User", test.forwardedUser)
+		}
+
+		r.ServeHTTP(response, request)
+
+		if got, want := response.Code, http.StatusFound; got != want {
+			t.Errorf("%s: s.Load(...) had response code %d, want %d\n%v", test.desc, got, want, response)
+		}
+
+		if got, want := response.HeaderMap.Get("Location"), test.expectRedirect; got != want {
+			t.Errorf("%s: s.Load(...) redirected to %q, want %q", test.desc, got, want)
+		}
+	}
+}
+
+type recordedHits []hit
+
+func (r *recordedHits) Record(h hit) {
+	*r = append(*r, h)
+}
+
+func TestStats(t *testing.T) {
+	testTime, err := time.Parse("2006-01-02", "2020-09-03")
+	if err != nil {
+		t.Fatalf("Could not parse the testing time: %v", err)
+	}
+	db := &memoryDatabase{}
+	if err := db.SaveURL(context.Background(), namedURL{Name: "wiki", URL: "http://github.com/bayesimpact/wiki"}); err != nil {
+		t.Fatalf("test setup error, could not save: %v", err)
+	}
+	var hits recordedHits
+	s := &server{Clock: fakeClock{now: testTime}, DB: db, Analytics: &hits, Stats: db}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/_/list", s.List).Methods("POST")
+	r.HandleFunc("/_/{name}/stats", s.LinkStats).Methods("GET")
+	r.HandleFunc("/{name}{folder:(?:/.*)?}", s.Load)
+
+	request, err := http.NewRequest("GET", "http://go/wiki/Home", nil)
+	if err != nil {
+		t.Fatalf("test setup error, impossible to create request: %v", err)
+	}
+	request.Header.Set("X-Forwarded-User", "lascap")
+	request.Header.Set("Referer", "http://example.com")
+	r.ServeHTTP(httptest.NewRecorder(), request)
+
+	request, err = http.NewRequest("GET", "http://go/missing", nil)
+	if err != nil {
+		t.Fatalf("test setup error, impossible to create request: %v", err)
+	}
+	r.ServeHTTP(httptest.NewRecorder(), request)
+
+	wantHits := recordedHits{{Time: testTime, Name: "wiki", Referer: "http://example.com", User: "lascap"}}
+	if !reflect.DeepEqual(hits, wantHits) {
+		t.Errorf("s.Load(...) recorded hits %v, want %v", hits, wantHits)
+	}
+
+	for _, h := range hits {
+		if err := db.AddHits(context.Background(), h.Name, h.Time.Format(statsDayFormat), 1, h.Time); err != nil {
+			t.Fatalf("test setup error, could not add hits: %v", err)
+		}
+	}
+
+	tests := []struct {
+		desc       string
+		method     string
+		url        string
+		expectBody string
+	}{
+		{
+			desc:       "Stats",
+			method:     "GET",
+			url:        "http://go/_/wiki/stats",
+			expectBody: `{"name":"wiki","hits":1,"lastUsed":"2020-09-03T00:00:00Z","daily":{"2020-09-03":1}}`,
+		},
+		{
+			desc:       "Stats of an unused link",
+			method:     "GET",
+			url:        "http://go/_/google/stats",
+			expectBody: `{"name":"google","hits":0}`,
+		},
+		{
+			desc:   "List",
+			method: "POST",
+			url:    "http://go/_/list",
+			expectBody: `{"urls":[{"name":"wiki","url":"http://github.com/bayesimpact/wiki","owners":null,"shouldExpandDates":false,` +
+				`"hits":1,"lastUsed":"2020-09-03T00:00:00Z"}]}`,
+		},
+	}
+
+	for _, test := range tests {
+		response := httptest.NewRecorder()
+		request, err := http.NewRequest(test.method, test.url, nil)
+		if err != nil {
+			t.Errorf("%s: test setup error, impossible to create request: %v", test.desc, err)
+			continue
+		}
+
+		r.ServeHTTP(response, request)
+
+		if got, want := response.Code, http.StatusOK; got != want {
+			t.Errorf("%s: had response code %d, want %d\n%v", test.desc, got, want, response)
+			continue
+		}
+
+		if got, want := response.Body.String(), test.expectBody; got != want {
+			t.Errorf("%s: returned a body with %q, want %q", test.desc, got, want)
+		}
+	}
+}
+
 func TestSave(t *testing.T) {
 	tests := []struct {
 		desc            string
 		body            string
 		saveURLError    error
+		existingURL     *namedURL
 		expectSavedURLs map[string]string
 		expectCode      int
 		expectBody      string
@@ -348,6 +581,16 @@ func TestSave(t *testing.T) {
 			expectSavedURLs: map[string]string{"wiki": "http://github.com/bayesimpact/wiki"},
 			expectBody:      `{"error":"Could not connect to DB"}` + "\n",
 		},
+		{
+			desc:            "Name already taken",
+			body:            `{"name": "wiki", "url": "http://github.com/bayesimpact/wiki"}`,
+			saveURLError:    AlreadyExistsError{"wiki"},
+			existingURL:     &namedURL{Name: "wiki", URL: "http://en.wikipedia.org", Owners: []string{"lascap"}},
+			expectCode:      http.StatusConflict,
+			expectSavedURLs: map[string]string{"wiki": "http://github.com/bayesimpact/wiki"},
+			expectBody: `{"error":"The name \"wiki\" is already taken",` +
+				`"existing":{"name":"wiki","url":"http://en.wikipedia.org","owners":["lascap"],"shouldExpandDates":false}}` + "\n",
+		},
 		{
 			desc:            "Not an URL",
 			body:            `{"name": "wiki", "url": ":^@$"}`,
@@ -366,6 +609,12 @@ func TestSave(t *testing.T) {
 					savedURLs[name] = url
 					return test.saveURLError
 				},
+				loadURL: func(name string) (namedURL, error) {
+					if test.existingURL == nil {
+						return namedURL{}, NotFoundError{name}
+					}
+					return *test.existingURL, nil
+				},
 			},
 		}
 
@@ -402,6 +651,7 @@ func TestDelete(t *testing.T) {
 		desc              string
 		request           string
 		forwardedUser     string
+		forwardedGroups   string
 		deleteURLError    error
 		expectDeletedURLs []string
 		expectCode        int
@@ -415,6 +665,15 @@ func TestDelete(t *testing.T) {
 			expectCode:        http.StatusOK,
 			expectBody:        `{"success":true}`,
 		},
+		{
+			desc:              "Member of groups",
+			request:           "/wiki",
+			forwardedUser:     "lascap",
+			forwardedGroups:   "platform, infra",
+			expectDeletedURLs: []string{"wiki", "lascap,group:platform,group:infra"},
+			expectCode:        http.StatusOK,
+			expectBody:        `{"success":true}`,
+		},
 		{
 			desc:       "Missing user",
 			request:    "/wiki",
@@ -450,6 +709,8 @@ func TestDelete(t *testing.T) {
 				},
 			},
 			SuperUser: map[string]bool{"SUPER USER": true},
+			Clock:     realClock{},
+			Groups:    headerGroups{},
 		}
 
 		r := mux.NewRouter()
@@ -464,6 +725,9 @@ func TestDelete(t *testing.T) {
 		if test.forwardedUser != "" {
 			request.Header.Set("X-Forwarded-User", test.forwardedUser)
 		}
+		if test.forwardedGroups != "" {
+			request.Header.Set("X-Forwarded-Groups", test.forwardedGroups)
+		}
 
 		r.ServeHTTP(response, request)
 
@@ -482,25 +746,757 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestUpdate(t *testing.T) {
+	tests := []struct {
+		desc              string
+		request           string
+		body              string
+		forwardedUser     string
+		updateURLError    error
+		expectUpdatedURLs []string
+		expectCode        int
+		expectBody        string
+	}{
+		{
+			desc:              "Typical update",
+			request:           "/wiki",
+			body:              `{"url": "http://en.wikipedia.org", "shouldExpandDates": true}`,
+			forwardedUser:     "lascap",
+			expectUpdatedURLs: []string{"wiki", "http://en.wikipedia.org", "true", "lascap"},
+			expectCode:        http.StatusOK,
+			expectBody:        `{"name":"wiki"}`,
+		},
+		{
+			desc:       "Missing user",
+			request:    "/wiki",
+			body:       `{"url": "http://en.wikipedia.org"}`,
+			expectCode: http.StatusUnauthorized,
+			expectBody: `{"error":"Request with no user"}` + "\n",
+		},
+		{
+			desc:          "Missing URL",
+			request:       "/wiki",
+			body:          `{"shouldExpandDates": true}`,
+			forwardedUser: "lascap",
+			expectCode:    http.StatusBadRequest,
+			expectBody:    `{"error":"Missing URL for \"wiki\""}` + "\n",
+		},
+		{
+			desc:          "Not an URL",
+			request:       "/wiki",
+			body:          `{"url": ":^@$"}`,
+			forwardedUser: "lascap",
+			expectCode:    http.StatusBadRequest,
+			expectBody:    `{"error":"Not a valid URL: \":^@$\"."}` + "\n",
+		},
+		{
+			desc:          "Unparseable json",
+			request:       "/wiki",
+			body:          `{--}`,
+			forwardedUser: "lascap",
+			expectCode:    http.StatusBadRequest,
+			expectBody:    `{"error":"Unable to parse json"}` + "\n",
+		},
+		{
+			desc:              "DB error",
+			request:           "/wiki",
+			body:              `{"url": "http://en.wikipedia.org"}`,
+			forwardedUser:     "lascap",
+			updateURLError:    errors.New("failure!"),
+			expectUpdatedURLs: []string{"wiki", "http://en.wikipedia.org", "false", "lascap"},
+			expectCode:        http.StatusInternalServerError,
+			expectBody:        `{"error":"failure!"}` + "\n",
+		},
+		{
+			desc:              "Super user",
+			request:           "/wiki",
+			body:              `{"url": "http://en.wikipedia.org"}`,
+			forwardedUser:     "SUPER USER",
+			expectUpdatedURLs: []string{"wiki", "http://en.wikipedia.org", "false", ""},
+			expectCode:        http.StatusOK,
+			expectBody:        `{"name":"wiki"}`,
+		},
+	}
+
+	for _, test := range tests {
+		var updatedURLs []string
+		s := &server{
+			DB: &stubDB{
+				loadURL: func(name string) (namedURL, error) {
+					return namedURL{Name: name, URL: "http://fr.wikipedia.org"}, nil
+				},
+				updateURL: func(name string, url string, shouldExpandDates bool, user string) error {
+					updatedURLs = append(updatedURLs, name, url, fmt.Sprint(shouldExpandDates), user)
+					return test.updateURLError
+				},
+			},
+			SuperUser: map[string]bool{"SUPER USER": true},
+			Clock:     realClock{},
+		}
+
+		r := mux.NewRouter()
+		r.HandleFunc("/{name}", s.Update).Methods("PUT")
+
+		response := httptest.NewRecorder()
+		request, err := http.NewRequest("PUT", fmt.Sprintf("http://go%s", test.request), strings.NewReader(test.body))
+		if err != nil {
+			t.Errorf("%s: test setup error, impossible to create request: %v", test.desc, err)
+			continue
+		}
+		if test.forwardedUser != "" {
+			request.Header.Set("X-Forwarded-User", test.forwardedUser)
+		}
+
+		r.ServeHTTP(response, request)
+
+		if got, want := response.Code, test.expectCode; got != want {
+			t.Errorf("%s: s.Update(...) had response code %d, want %d\n%v", test.desc, got, want, response)
+			continue
+		}
+
+		if !reflect.DeepEqual(updatedURLs, test.expectUpdatedURLs) {
+			t.Errorf("%s: s.Update(...) updated these URLs\n%v\nbut wanted those\n%v", test.desc, updatedURLs, test.expectUpdatedURLs)
+		}
+
+		if got, want := response.Body.String(), test.expectBody; got != want {
+			t.Errorf("%s: s.Update(...) returned a body with %q, want %q", test.desc, got, want)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	tests := []struct {
+		desc            string
+		request         string
+		searchURLs      []namedURL
+		searchURLsError error
+		expectSearches  []string
+		expectCode      int
+		expectBody      string
+	}{
+		{
+			desc:    "Typical search",
+			request: "?q=wiki",
+			searchURLs: []namedURL{
+				{
+					Name:        "wiki",
+					URL:         "http://github.com/bayesimpact/wiki",
+					Owners:      []string{"lascap"},
+					Description: "Our internal wiki",
+				},
+			},
+			expectSearches: []string{"wiki 20"},
+			expectCode:     http.StatusOK,
+			expectBody: `{"urls":[` +
+				`{"name":"wiki","url":"http://github.com/bayesimpact/wiki","owners":["lascap"],"shouldExpandDates":false,"description":"Our internal wiki"}` +
+				`]}`,
+		},
+		{
+			desc:           "No results",
+			request:        "?q=wiki&limit=5",
+			expectSearches: []string{"wiki 5"},
+			expectCode:     http.StatusOK,
+			expectBody:     `{"urls":[]}`,
+		},
+		{
+			desc:       "Missing query",
+			request:    "?q=+",
+			expectCode: http.StatusBadRequest,
+			expectBody: `{"error":"Missing query"}` + "\n",
+		},
+		{
+			desc:       "Invalid limit",
+			request:    "?q=wiki&limit=-1",
+			expectCode: http.StatusBadRequest,
+			expectBody: `{"error":"Not a valid limit: \"-1\""}` + "\n",
+		},
+		{
+			desc:            "DB error",
+			request:         "?q=wiki",
+			searchURLsError: errors.New("failure!"),
+			expectSearches:  []string{"wiki 20"},
+			expectCode:      http.StatusInternalServerError,
+			expectBody:      `{"error":"failure!"}` + "\n",
+		},
+	}
+
+	for _, test := range tests {
+		var searches []string
+		s := &server{
+			Clock: realClock{},
+			DB: &stubDB{
+				searchURLs: func(query string, limit int) ([]namedURL, error) {
+					searches = append(searches, fmt.Sprintf("%s %d", query, limit))
+					return test.searchURLs, test.searchURLsError
+				},
+			},
+		}
+
+		r := mux.NewRouter()
+		r.HandleFunc("/search", s.Search).Methods("GET")
+
+		response := httptest.NewRecorder()
+		request, err := http.NewRequest("GET", "http://go/search"+test.request, nil)
+		if err != nil {
+			t.Errorf("%s: test setup error, impossible to create request: %v", test.desc, err)
+			continue
+		}
+
+		r.ServeHTTP(response, request)
+
+		if got, want := response.Code, test.expectCode; got != want {
+			t.Errorf("%s: s.Search(...) had response code %d, want %d\n%v", test.desc, got, want, response)
+			continue
+		}
+
+		if !reflect.DeepEqual(searches, test.expectSearches) {
+			t.Errorf("%s: s.Search(...) searched for %q, want %q", test.desc, searches, test.expectSearches)
+		}
+
+		if got, want := response.Body.String(), test.expectBody; got != want {
+			t.Errorf("%s: s.Search(...) returned a body with %q, want %q", test.desc, got, want)
+		}
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	s := &server{DB: &stubDB{}}
+
+	response := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "http://go/_/healthz", nil)
+	if err != nil {
+		t.Fatalf("test setup error, impossible to create request: %v", err)
+	}
+
+	s.Healthz(response, request)
+
+	if got, want := response.Code, http.StatusOK; got != want {
+		t.Errorf("s.Healthz(...) had response code %d, want %d\n%v", got, want, response)
+	}
+	if got, want := response.Body.String(), `{"status":"ok"}`; got != want {
+		t.Errorf("s.Healthz(...) returned a body with %q, want %q", got, want)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		desc       string
+		pingError  error
+		expectCode int
+		expectBody string
+	}{
+		{
+			desc:       "Ready",
+			expectCode: http.StatusOK,
+			expectBody: `{"status":"ok"}`,
+		},
+		{
+			desc:       "DB unreachable",
+			pingError:  errors.New("Could not connect to DB"),
+			expectCode: http.StatusServiceUnavailable,
+			expectBody: `{"error":"Could not connect to DB"}` + "\n",
+		},
+	}
+
+	for _, test := range tests {
+		pings := 0
+		s := &server{
+			DB: &stubDB{
+				ping: func() error {
+					pings++
+					return test.pingError
+				},
+			},
+		}
+
+		response := httptest.NewRecorder()
+		request, err := http.NewRequest("GET", "http://go/_/readyz", nil)
+		if err != nil {
+			t.Errorf("%s: test setup error, impossible to create request: %v", test.desc, err)
+			continue
+		}
+
+		s.Readyz(response, request)
+
+		if got, want := response.Code, test.expectCode; got != want {
+			t.Errorf("%s: s.Readyz(...) had response code %d, want %d\n%v", test.desc, got, want, response)
+		}
+		if got, want := response.Body.String(), test.expectBody; got != want {
+			t.Errorf("%s: s.Readyz(...) returned a body with %q, want %q", test.desc, got, want)
+		}
+		if pings != 1 {
+			t.Errorf("%s: s.Readyz(...) pinged the DB %d times, want once", test.desc, pings)
+		}
+	}
+}
+
+func TestSaveLoadDeleteWithMemoryDatabase(t *testing.T) {
+	s := &server{Clock: realClock{}, DB: &memoryDatabase{}}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/_/save", s.Save).Methods("POST")
+	r.HandleFunc("/_/{name}", s.Delete).Methods("DELETE")
+	r.HandleFunc("/{name}{folder:(?:/.*)?}", s.Load)
+
+	steps := []struct {
+		desc           string
+		method         string
+		url            string
+		body           string
+		expectCode     int
+		expectRedirect string
+	}{
+		{
+			desc:       "Save",
+			method:     "POST",
+			url:        "http://go/_/save",
+			body:       `{"name": "wiki", "url": "http://github.com/bayesimpact/wiki"}`,
+			expectCode: http.StatusOK,
+		},
+		{
+			desc:       "Save again",
+			method:     "POST",
+			url:        "http://go/_/save",
+			body:       `{"name": "wiki", "url": "http://en.wikipedia.org"}`,
+			expectCode: http.StatusConflict,
+		},
+		{
+			desc:           "Load",
+			method:         "GET",
+			url:            "http://go/wiki/Home",
+			expectCode:     http.StatusMovedPermanently,
+			expectRedirect: "http://github.com/bayesimpact/wiki/Home",
+		},
+		{
+			desc:       "Delete",
+			method:     "DELETE",
+			url:        "http://go/_/wiki",
+			expectCode: http.StatusOK,
+		},
+		{
+			desc:           "Load after delete",
+			method:         "GET",
+			url:            "http://go/wiki",
+			expectCode:     http.StatusFound,
+			expectRedirect: "/#/?error=No+such+URL+yet.+Feel+free+to+add+one.&name=wiki",
+		},
+	}
+
+	for _, step := range steps {
+		response := httptest.NewRecorder()
+		request, err := http.NewRequest(step.method, step.url, strings.NewReader(step.body))
+		if err != nil {
+			t.Fatalf("%s: test setup error, impossible to create request: %v", step.desc, err)
+		}
+		request.Header.Set("X-Forwarded-User", "lascap")
+
+		r.ServeHTTP(response, request)
+
+		if got, want := response.Code, step.expectCode; got != want {
+			t.Errorf("%s: had response code %d, want %d\n%v", step.desc, got, want, response)
+		}
+		if want := step.expectRedirect; want != "" {
+			if got := response.HeaderMap.Get("Location"); got != want {
+				t.Errorf("%s: redirected to %q, want %q", step.desc, got, want)
+			}
+		}
+	}
+}
+
+func TestHistoryAndRevert(t *testing.T) {
+	testTime, err := time.Parse("2006-01-02", "2020-09-03")
+	if err != nil {
+		t.Fatalf("Could not parse the testing time: %v", err)
+	}
+	s := &server{Clock: fakeClock{now: testTime}, DB: &memoryDatabase{}}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/_/save", s.Save).Methods("POST")
+	r.HandleFunc("/_/{name}/history", s.History).Methods("GET")
+	r.HandleFunc("/_/{name}/revert", s.Revert).Methods("POST")
+	r.HandleFunc("/_/{name}", s.Update).Methods("PUT")
+	r.HandleFunc("/_/{name}", s.Delete).Methods("DELETE")
+	r.HandleFunc("/{name}{folder:(?:/.*)?}", s.Load)
+
+	steps := []struct {
+		desc           string
+		method         string
+		url            string
+		body           string
+		forwardedUser  string
+		expectCode     int
+		expectBody     string
+		expectRedirect string
+	}{
+		{
+			desc:          "Save",
+			method:        "POST",
+			url:           "http://go/_/save",
+			body:          `{"name": "wiki", "url": "http://github.com/bayesimpact/wiki"}`,
+			forwardedUser: "lascap",
+			expectCode:    http.StatusOK,
+		},
+		{
+			desc:          "Update",
+			method:        "PUT",
+			url:           "http://go/_/wiki",
+			body:          `{"url": "http://en.wikipedia.org"}`,
+			forwardedUser: "lascap",
+			expectCode:    http.StatusOK,
+		},
+		{
+			desc:          "History",
+			method:        "GET",
+			url:           "http://go/_/wiki/history",
+			forwardedUser: "other",
+			expectCode:    http.StatusOK,
+			expectBody: `{"revisions":[` +
+				`{"name":"wiki","user":"lascap","time":"2020-09-03T00:00:00Z","action":"save",` +
+				`"after":{"name":"wiki","url":"http://github.com/bayesimpact/wiki","owners":["lascap"],"shouldExpandDates":false}},` +
+				`{"name":"wiki","user":"lascap","time":"2020-09-03T00:00:00Z","action":"update",` +
+				`"before":{"name":"wiki","url":"http://github.com/bayesimpact/wiki","owners":["lascap"],"shouldExpandDates":false},` +
+				`"after":{"name":"wiki","url":"http://en.wikipedia.org","owners":["lascap"],"shouldExpandDates":false}}` +
+				`]}`,
+		},
+		{
+			desc:          "Revert by someone else",
+			method:        "POST",
+			url:           "http://go/_/wiki/revert",
+			body:          `{"revision": 0}`,
+			forwardedUser: "other",
+			expectCode:    http.StatusInternalServerError,
+		},
+		{
+			desc:          "Revert to a missing revision",
+			method:        "POST",
+			url:           "http://go/_/wiki/revert",
+			body:          `{"revision": 2}`,
+			forwardedUser: "lascap",
+			expectCode:    http.StatusNotFound,
+			expectBody:    `{"error":"No revision 2 for \"wiki\""}` + "\n",
+		},
+		{
+			desc:          "Revert",
+			method:        "POST",
+			url:           "http://go/_/wiki/revert",
+			body:          `{"revision": 0}`,
+			forwardedUser: "lascap",
+			expectCode:    http.StatusOK,
+			expectBody:    `{"name":"wiki"}`,
+		},
+		{
+			desc:           "Load after revert",
+			method:         "GET",
+			url:            "http://go/wiki",
+			expectCode:     http.StatusMovedPermanently,
+			expectRedirect: "http://github.com/bayesimpact/wiki",
+		},
+		{
+			desc:          "Delete",
+			method:        "DELETE",
+			url:           "http://go/_/wiki",
+			forwardedUser: "lascap",
+			expectCode:    http.StatusOK,
+		},
+		{
+			desc:          "Revert to a deletion",
+			method:        "POST",
+			url:           "http://go/_/wiki/revert",
+			body:          `{"revision": 3}`,
+			forwardedUser: "lascap",
+			expectCode:    http.StatusBadRequest,
+			expectBody:    `{"error":"Revision 3 of \"wiki\" is a deletion"}` + "\n",
+		},
+		{
+			desc:          "Restore by someone else",
+			method:        "POST",
+			url:           "http://go/_/wiki/revert",
+			body:          `{"revision": 1}`,
+			forwardedUser: "other",
+			expectCode:    http.StatusForbidden,
+		},
+		{
+			desc:          "Restore a deleted URL",
+			method:        "POST",
+			url:           "http://go/_/wiki/revert",
+			body:          `{"revision": 1}`,
+			forwardedUser: "lascap",
+			expectCode:    http.StatusOK,
+		},
+		{
+			desc:           "Load after restore",
+			method:         "GET",
+			url:            "http://go/wiki",
+			expectCode:     http.StatusMovedPermanently,
+			expectRedirect: "http://en.wikipedia.org",
+		},
+	}
+
+	for _, step := range steps {
+		response := httptest.NewRecorder()
+		request, err := http.NewRequest(step.method, step.url, strings.NewReader(step.body))
+		if err != nil {
+			t.Fatalf("%s: test setup error, impossible to create request: %v", step.desc, err)
+		}
+		if step.forwardedUser != "" {
+			request.Header.Set("X-Forwarded-User", step.forwardedUser)
+		}
+
+		r.ServeHTTP(response, request)
+
+		if got, want := response.Code, step.expectCode; got != want {
+			t.Errorf("%s: had response code %d, want %d\n%v", step.desc, got, want, response)
+		}
+		if want := step.expectBody; want != "" {
+			if got := response.Body.String(); got != want {
+				t.Errorf("%s: returned a body with %q, want %q", step.desc, got, want)
+			}
+		}
+		if want := step.expectRedirect; want != "" {
+			if got := response.HeaderMap.Get("Location"); got != want {
+				t.Errorf("%s: redirected to %q, want %q", step.desc, got, want)
+			}
+		}
+	}
+}
+
+func TestDatabaseTimeouts(t *testing.T) {
+	tests := []struct {
+		desc       string
+		db         database
+		expectCode int
+		expectBody string
+	}{
+		{
+			desc:       "Hung DB",
+			db:         deadlineDatabase{db: hungDB{}, timeout: 10 * time.Millisecond},
+			expectCode: http.StatusGatewayTimeout,
+			expectBody: `{"error":"The database took too long to answer"}` + "\n",
+		},
+		{
+			desc: "Unreachable DB",
+			db: &stubDB{
+				listURLs: func(listQuery) ([]namedURL, string, error) {
+					return nil, "", fmt.Errorf("Could not list: %w", mongo.ErrClientDisconnected)
+				},
+			},
+			expectCode: http.StatusServiceUnavailable,
+			expectBody: `{"error":"The database is unavailable"}` + "\n",
+		},
+	}
+
+	for _, test := range tests {
+		s := &server{DB: test.db}
+
+		response := httptest.NewRecorder()
+		request, err := http.NewRequest("POST", "http://go/_/list", nil)
+		if err != nil {
+			t.Errorf("%s: test setup error, impossible to create request: %v", test.desc, err)
+			continue
+		}
+
+		s.List(response, request)
+
+		if got, want := response.Code, test.expectCode; got != want {
+			t.Errorf("%s: s.List(...) had response code %d, want %d\n%v", test.desc, got, want, response)
+		}
+		if got, want := response.Body.String(), test.expectBody; got != want {
+			t.Errorf("%s: s.List(...) returned a body with %q, want %q", test.desc, got, want)
+		}
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	s := &server{DB: hungDB{}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	response := httptest.NewRecorder()
+	request, err := http.NewRequest("POST", "http://go/_/list", nil)
+	if err != nil {
+		t.Fatalf("test setup error, impossible to create request: %v", err)
+	}
+
+	// hungDB only returns once the request is canceled.
+	s.List(response, request.WithContext(ctx))
+
+	if got, want := response.Code, http.StatusInternalServerError; got != want {
+		t.Errorf("s.List(...) had response code %d, want %d\n%v", got, want, response)
+	}
+}
+
+func TestAnonymousLinks(t *testing.T) {
+	tests := []struct {
+		desc         string
+		policy       anonymousPolicy
+		user         string
+		expectCode   int
+		expectExpiry bool
+	}{
+		{
+			desc:       "Allowed by default",
+			expectCode: http.StatusOK,
+		},
+		{
+			desc:       "Denied",
+			policy:     anonymousDeny,
+			expectCode: http.StatusUnauthorized,
+		},
+		{
+			desc:       "Denied but with a user",
+			policy:     anonymousDeny,
+			user:       "lascap",
+			expectCode: http.StatusOK,
+		},
+		{
+			desc:         "Expiring",
+			policy:       anonymousExpire,
+			expectCode:   http.StatusOK,
+			expectExpiry: true,
+		},
+		{
+			desc:       "Expiring but with a user",
+			policy:     anonymousExpire,
+			user:       "lascap",
+			expectCode: http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		db := &memoryDatabase{}
+		s := &server{
+			DB:                db,
+			Clock:             fakeClock{time.Date(2020, 9, 3, 10, 0, 0, 0, time.UTC)},
+			AnonymousLinks:    test.policy,
+			AnonymousLinksTTL: 24 * time.Hour,
+		}
+
+		response := serveAs(http.HandlerFunc(s.Save), "POST", "/_/save",
+			`{"name":"wiki","url":"http://en.wikipedia.org","owners":["forged"],"expiresAt":"2030-01-01T00:00:00Z"}`, test.user)
+
+		if got, want := response.Code, test.expectCode; got != want {
+			t.Errorf("%s: s.Save(...) had response code %d, want %d\n%v", test.desc, got, want, response)
+			continue
+		}
+		if test.expectCode != http.StatusOK {
+			continue
+		}
+
+		u, err := db.LoadURL(context.Background(), "wiki")
+		if err != nil {
+			t.Errorf("%s: s.Save(...) did not save the URL: %v", test.desc, err)
+			continue
+		}
+		if test.user == "" && len(u.Owners) > 0 {
+			t.Errorf("%s: s.Save(...) saved an anonymous link owned by %q", test.desc, u.Owners)
+		}
+		want := (*time.Time)(nil)
+		if test.expectExpiry {
+			expiresAt := time.Date(2020, 9, 4, 10, 0, 0, 0, time.UTC)
+			want = &expiresAt
+		}
+		if !reflect.DeepEqual(u.ExpiresAt, want) {
+			t.Errorf("%s: s.Save(...) saved a URL expiring at %v, want %v", test.desc, u.ExpiresAt, want)
+		}
+	}
+}
+
+func TestExpiredLinks(t *testing.T) {
+	db := &memoryDatabase{}
+	clock := &fakeClock{time.Date(2020, 9, 3, 10, 0, 0, 0, time.UTC)}
+	s := &server{
+		DB:                db,
+		Clock:             clock,
+		SuperUser:         map[string]bool{"SUPER USER": true},
+		AnonymousLinks:    anonymousExpire,
+		AnonymousLinksTTL: 24 * time.Hour,
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/_/list", s.List).Methods("POST")
+	r.HandleFunc("/_/save", s.Save).Methods("POST")
+	r.HandleFunc("/_/search", s.Search).Methods("GET")
+	r.HandleFunc("/_/{name}/claim", s.Claim).Methods("POST")
+	r.HandleFunc("/{name}", s.Load)
+	serveAs(r, "POST", "/_/save", `{"name":"wiki","url":"http://en.wikipedia.org"}`, "")
+	serveAs(r, "POST", "/_/save", `{"name":"other","url":"http://example.com"}`, "")
+	if response := serveAs(r, "GET", "/wiki", "", ""); response.Code != http.StatusMovedPermanently {
+		t.Errorf("Loading an anonymous link had response code %d, want %d", response.Code, http.StatusMovedPermanently)
+	}
+
+	if response := serveAs(r, "POST", "/_/wiki/claim", "", "lascap"); response.Code != http.StatusForbidden {
+		t.Errorf("Claiming a link as a normal user had response code %d, want %d", response.Code, http.StatusForbidden)
+	}
+	response := serveAs(r, "POST", "/_/wiki/claim", "", "SUPER USER")
+	if got, want := response.Body.String(), `{"name":"wiki","owners":["SUPER USER"]}`; got != want {
+		t.Errorf("Claiming a link returned %q, want %q", got, want)
+	}
+	if response := serveAs(r, "POST", "/_/wiki/claim", "", "SUPER USER"); response.Code != http.StatusConflict {
+		t.Errorf("Claiming an owned link had response code %d, want %d", response.Code, http.StatusConflict)
+	}
+
+	clock.now = clock.now.Add(48 * time.Hour)
+	if got := serveAs(r, "POST", "/_/list", "", "lascap").Body.String(); strings.Contains(got, `"other"`) {
+		t.Errorf("Listing links returned the expired link: %q", got)
+	}
+	if got := serveAs(r, "POST", "/_/list", "", "SUPER USER").Body.String(); !strings.Contains(got, `"other"`) {
+		t.Errorf("Listing links as a super user did not return the expired link: %q", got)
+	}
+	if got := serveAs(r, "GET", "/_/search?q=example", "", "lascap").Body.String(); strings.Contains(got, `"other"`) {
+		t.Errorf("Searching links returned the expired link: %q", got)
+	}
+	if response := serveAs(r, "GET", "/othe", "", "lascap"); strings.Contains(response.Header().Get("Location"), "suggestion=other") {
+		t.Errorf("Loading a missing link suggested the expired link: %q", response.Header().Get("Location"))
+	}
+	if response := serveAs(r, "GET", "/wiki", "", ""); response.Code != http.StatusMovedPermanently {
+		t.Errorf("Loading a claimed link had response code %d, want %d", response.Code, http.StatusMovedPermanently)
+	}
+	if response := serveAs(r, "GET", "/other", "", ""); response.Code != http.StatusFound || !strings.HasPrefix(response.Header().Get("Location"), "/#/?") {
+		t.Errorf("Loading an expired link had response code %d to %q, want a redirect to the home page", response.Code, response.Header().Get("Location"))
+	}
+	if response := serveAs(r, "POST", "/_/save", `{"name":"other","url":"http://example.com/new"}`, "lascap"); response.Code != http.StatusOK {
+		t.Errorf("Reusing the name of an expired link had response code %d, want %d\n%v", response.Code, http.StatusOK, response)
+	}
+	if u, err := db.LoadURL(context.Background(), "other"); err != nil || u.URL != "http://example.com/new" || u.ExpiresAt != nil {
+		t.Errorf("The name of an expired link was reused for %#v, %v", u, err)
+	}
+}
+
+// A hungDB is a database that never answers before its context is done.
+type hungDB struct {
+	stubDB
+}
+
+func (hungDB) ListURLs(ctx context.Context, q listQuery) ([]namedURL, string, error) {
+	<-ctx.Done()
+	return nil, "", ctx.Err()
+}
+
 type stubDB struct {
-	deleteURL func(string, string) error
-	listURLs  func() ([]namedURL, error)
-	loadURL   func(string) (namedURL, error)
-	saveURL   func(string, string, []string, bool) error
+	// deleteURL and updateURL get the principals joined with commas.
+	deleteURL     func(string, string) error
+	listURLs      func(listQuery) ([]namedURL, string, error)
+	loadURL       func(string) (namedURL, error)
+	saveURL       func(string, string, []string, bool) error
+	updateURL     func(string, string, bool, string) error
+	setOwners     func(name string, action string, owners []string, principals string) error
+	saveRevision  func(revision) error
+	listRevisions func(string) ([]revision, error)
+	searchURLs    func(string, int) ([]namedURL, error)
+	ping          func() error
 }
 
-func (s stubDB) DeleteURL(ctx context.Context, name, user string) error {
+func (s stubDB) DeleteURL(ctx context.Context, name string, principals []string) (namedURL, error) {
 	if s.deleteURL == nil {
-		return errors.New("DeleteURL called")
+		return namedURL{}, errors.New("DeleteURL called")
 	}
-	return s.deleteURL(name, user)
+	return namedURL{Name: name}, s.deleteURL(name, strings.Join(principals, ","))
 }
 
-func (s stubDB) ListURLs(ctx context.Context) ([]namedURL, error) {
+func (s stubDB) ListURLs(ctx context.Context, q listQuery) ([]namedURL, string, error) {
 	if s.listURLs == nil {
-		return nil, errors.New("ListURLs called")
+		return nil, "", errors.New("ListURLs called")
 	}
-	return s.listURLs()
+	return s.listURLs(q)
 }
 
 func (s stubDB) LoadURL(ctx context.Context, name string) (namedURL, error) {
@@ -510,9 +1506,71 @@ func (s stubDB) LoadURL(ctx context.Context, name string) (namedURL, error) {
 	return s.loadURL(name)
 }
 
-func (s stubDB) SaveURL(ctx context.Context, name string, url string, owners []string, shouldExpandDates bool) error {
+func (s stubDB) SaveURL(ctx context.Context, u namedURL) error {
 	if s.saveURL == nil {
-		return fmt.Errorf("SaveURL(%q, %q, %v, %t) called", name, url, owners, shouldExpandDates)
+		return fmt.Errorf("SaveURL(%#v) called", u)
+	}
+	return s.saveURL(u.Name, u.URL, u.Owners, u.ShouldExpandDates)
+}
+
+func (s stubDB) UpdateURL(ctx context.Context, u namedURL, principals []string) (namedURL, error) {
+	if s.updateURL == nil {
+		return namedURL{}, fmt.Errorf("UpdateURL(%#v, %q) called", u, principals)
+	}
+	return namedURL{Name: u.Name}, s.updateURL(u.Name, u.URL, u.ShouldExpandDates, strings.Join(principals, ","))
+}
+
+func (s stubDB) AddOwners(ctx context.Context, name string, owners []string, principals []string) (namedURL, error) {
+	if s.setOwners == nil {
+		return namedURL{}, fmt.Errorf("AddOwners(%q, %q) called", name, owners)
+	}
+	return namedURL{Name: name}, s.setOwners(name, "add", owners, strings.Join(principals, ","))
+}
+
+func (s stubDB) RemoveOwners(ctx context.Context, name string, owners []string, principals []string) (namedURL, error) {
+	if s.setOwners == nil {
+		return namedURL{}, fmt.Errorf("RemoveOwners(%q, %q) called", name, owners)
+	}
+	return namedURL{Name: name}, s.setOwners(name, "remove", owners, strings.Join(principals, ","))
+}
+
+func (s stubDB) SetOwners(ctx context.Context, name string, owners []string, principals []string) (namedURL, error) {
+	if s.setOwners == nil {
+		return namedURL{}, fmt.Errorf("SetOwners(%q, %q) called", name, owners)
+	}
+	return namedURL{Name: name}, s.setOwners(name, "set", owners, strings.Join(principals, ","))
+}
+
+func (s stubDB) SearchURLs(ctx context.Context, query string, limit int) ([]namedURL, error) {
+	if s.searchURLs == nil {
+		return nil, fmt.Errorf("SearchURLs(%q, %d) called", query, limit)
 	}
-	return s.saveURL(name, url, owners, shouldExpandDates)
+	return s.searchURLs(query, limit)
+}
+
+// SaveRevision silently drops the revision if saveRevision is not set, as
+// most handlers record revisions as a side effect.
+func (s stubDB) SaveRevision(ctx context.Context, rev revision) error {
+	if s.saveRevision == nil {
+		return nil
+	}
+	return s.saveRevision(rev)
+}
+
+func (s stubDB) ListRevisions(ctx context.Context, name string) ([]revision, error) {
+	if s.listRevisions == nil {
+		return nil, fmt.Errorf("ListRevisions(%q) called", name)
+	}
+	return s.listRevisions(name)
+}
+
+func (s stubDB) Ping(ctx context.Context) error {
+	if s.ping == nil {
+		return errors.New("Ping called")
+	}
+	return s.ping()
+}
+
+func (s stubDB) Close(ctx context.Context) error {
+	return nil
 }
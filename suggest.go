@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// maxSuggestions is the maximum number of existing names suggested when a
+// short name is not found.
+const maxSuggestions = 5
+
+// suggestNames finds existing short names close to one that was not found:
+// names at a small edit distance or sharing a long prefix with it. Names owned
+// by the user are accepted with a larger distance and suggested first, and
+// names not listed for the viewer are skipped. All the names are scanned, which
+// is fine as long as it only happens on not-found pages.
+func (s server) suggestNames(ctx context.Context, name string, user string, viewer []string) ([]string, error) {
+	type suggestion struct {
+		name     string
+		distance int
+		owned    bool
+	}
+	var suggestions []suggestion
+
+	lowerName := strings.ToLower(name)
+	maxDistance := 1 + len(lowerName)/4
+	q := listQuery{}
+	for {
+		urls, next, err := s.DB.ListURLs(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range listedFor(urls, viewer, s.Clock.Now()) {
+			candidate := strings.ToLower(u.Name)
+			owned := user != "" && isOwner(u, user)
+			distance := editDistance(lowerName, candidate)
+			prefix := commonPrefixLength(lowerName, candidate)
+			isClose := distance <= maxDistance ||
+				(owned && distance <= 2*maxDistance) ||
+				prefix >= 3 || (prefix > 0 && prefix == len(lowerName))
+			if isClose {
+				suggestions = append(suggestions, suggestion{u.Name, distance, owned})
+			}
+		}
+		if next == "" {
+			break
+		}
+		q.After = next
+	}
+
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].owned != suggestions[j].owned {
+			return suggestions[i].owned
+		}
+		if suggestions[i].distance != suggestions[j].distance {
+			return suggestions[i].distance < suggestions[j].distance
+		}
+		return suggestions[i].name < suggestions[j].name
+	})
+	if len(suggestions) > maxSuggestions {
+		suggestions = suggestions[:maxSuggestions]
+	}
+
+	names := make([]string, len(suggestions))
+	for i, s := range suggestions {
+		names[i] = s.name
+	}
+	return names, nil
+}
+
+// editDistance computes the Levenshtein distance between two strings: the
+// minimal number of rune insertions, deletions or substitutions to go from one
+// to the other.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, minInt(current[j-1]+1, previous[j-1]+cost))
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
+
+// commonPrefixLength returns the number of bytes at the start of both strings
+// that are equal.
+func commonPrefixLength(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	neturl "net/url"
+)
+
+// templateKind is the kind of the short URLs whose URL is a template filled
+// with the path segments following the short name, e.g. go/jira/PROJ-123 with
+// the template "https://jira.example.com/browse/%s", and with the query
+// parameters, e.g. go/search?q=bug with "https://search.example.com/?q={q}".
+const templateKind = "template"
+
+// templatePlaceholder matches the placeholders of a template: "%s" stands for
+// the next argument, "{n}" for the n-th one, starting at 1, and "{name}" for
+// the query parameter "name". The last two can have a default value used when
+// the argument or parameter is missing or empty, e.g. "{team=platform}".
+var templatePlaceholder = regexp.MustCompile(`%s|\{(?:([0-9]+)|([A-Za-z_][A-Za-z0-9_]*))(?:=([^{}]*))?\}`)
+
+// validateKind checks that the kind of a URL is known and, for templates, that
+// the template and its fallback are valid.
+func validateKind(u namedURL) error {
+	switch u.Kind {
+	case "":
+		if u.FallbackURL != "" {
+			return fmt.Errorf("Only template links can have a fallback URL")
+		}
+		return nil
+	case templateKind:
+	default:
+		return fmt.Errorf("Not a valid kind: %q", u.Kind)
+	}
+
+	if u.ShouldExpandDates {
+		return fmt.Errorf("Template links cannot expand dates")
+	}
+	matches := templatePlaceholder.FindAllStringSubmatch(u.URL, -1)
+	if len(matches) == 0 {
+		return fmt.Errorf("The template %q has no placeholder, use %%s, {1} or {param}", u.URL)
+	}
+	var hasNext, hasIndexed bool
+	for _, match := range matches {
+		if match[0] == "%s" {
+			hasNext = true
+			continue
+		}
+		if match[1] == "" {
+			continue
+		}
+		hasIndexed = true
+		if index, err := strconv.Atoi(match[1]); err != nil || index < 1 {
+			return fmt.Errorf("Not a valid placeholder in %q: %s, arguments start at {1}", u.URL, match[0])
+		}
+	}
+	if hasNext && hasIndexed {
+		return fmt.Errorf("The template %q mixes %%s and {n} placeholders", u.URL)
+	}
+	if u.FallbackURL != "" {
+		if templatePlaceholder.MatchString(u.FallbackURL) {
+			return fmt.Errorf("The fallback URL %q cannot have placeholders", u.FallbackURL)
+		}
+		if _, err := neturl.Parse(u.FallbackURL); err != nil {
+			return fmt.Errorf("Not a valid fallback URL: %q", u.FallbackURL)
+		}
+	}
+	return nil
+}
+
+// sampleURL returns the URL of a short URL, with sample values in place of
+// the placeholders for templates so that it can be parsed.
+func sampleURL(u namedURL) string {
+	if u.Kind != templateKind {
+		return u.URL
+	}
+	return templatePlaceholder.ReplaceAllString(u.URL, "x")
+}
+
+// templateArgs splits the escaped path following a short name in arguments
+// for a template, and unescapes them: an escaped slash stays in its argument.
+func templateArgs(escapedFolder string) []string {
+	var args []string
+	for _, arg := range strings.Split(escapedFolder, "/") {
+		if arg == "" {
+			continue
+		}
+		if unescaped, err := neturl.PathUnescape(arg); err == nil {
+			arg = unescaped
+		}
+		args = append(args, arg)
+	}
+	return args
+}
+
+// expandTemplate fills the placeholders of a template with the arguments and
+// the query parameters, escaped for the part of the URL they end up in. It
+// returns the names of the parameters it used, and false if some values are
+// missing without default. Extra arguments and parameters are ignored.
+func expandTemplate(template string, args []string, params neturl.Values) (string, []string, bool) {
+	queryStart := strings.Index(template, "?")
+	next := 0
+	ok := true
+	var used []string
+	var expanded strings.Builder
+	last := 0
+	for _, loc := range templatePlaceholder.FindAllStringSubmatchIndex(template, -1) {
+		expanded.WriteString(template[last:loc[0]])
+		last = loc[1]
+
+		var value string
+		switch {
+		case loc[2] >= 0:
+			if index, _ := strconv.Atoi(template[loc[2]:loc[3]]); index >= 1 && index <= len(args) {
+				value = args[index-1]
+			}
+		case loc[4] >= 0:
+			name := template[loc[4]:loc[5]]
+			value = params.Get(name)
+			used = append(used, name)
+		default:
+			if next < len(args) {
+				value = args[next]
+			}
+			next++
+		}
+		if value == "" {
+			if loc[6] < 0 {
+				ok = false
+				continue
+			}
+			value = template[loc[6]:loc[7]]
+		}
+
+		if queryStart >= 0 && loc[0] > queryStart {
+			expanded.WriteString(neturl.QueryEscape(value))
+		} else {
+			expanded.WriteString(neturl.PathEscape(value))
+		}
+	}
+	expanded.WriteString(template[last:])
+	return expanded.String(), used, ok
+}
+
+// mergeQuery adds the query parameters to a URL, except the ones it already
+// sets: the query of the URL is kept as is.
+func mergeQuery(url string, params neturl.Values) string {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return url
+	}
+	existing := u.Query()
+	extra := neturl.Values{}
+	for name, values := range params {
+		if _, ok := existing[name]; !ok {
+			extra[name] = values
+		}
+	}
+	if len(extra) == 0 {
+		return url
+	}
+	if u.RawQuery != "" {
+		u.RawQuery += "&"
+	}
+	u.RawQuery += extra.Encode()
+	return u.String()
+}
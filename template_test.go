@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	neturl "net/url"
+)
+
+func TestValidateKind(t *testing.T) {
+	tests := []struct {
+		desc        string
+		url         namedURL
+		expectError string
+	}{
+		{
+			desc: "Plain redirect",
+			url:  namedURL{URL: "http://en.wikipedia.org"},
+		},
+		{
+			desc: "Next placeholders",
+			url:  namedURL{URL: "https://jira.example.com/browse/%s", Kind: "template"},
+		},
+		{
+			desc: "Indexed placeholders with a fallback",
+			url:  namedURL{URL: "https://github.com/{1}/{2}", Kind: "template", FallbackURL: "https://github.com"},
+		},
+		{
+			desc:        "Unknown kind",
+			url:         namedURL{URL: "http://en.wikipedia.org", Kind: "magic"},
+			expectError: `Not a valid kind: "magic"`,
+		},
+		{
+			desc:        "Fallback without template",
+			url:         namedURL{URL: "http://en.wikipedia.org", FallbackURL: "http://example.com"},
+			expectError: "Only template links can have a fallback URL",
+		},
+		{
+			desc:        "No placeholder",
+			url:         namedURL{URL: "https://jira.example.com", Kind: "template"},
+			expectError: `The template "https://jira.example.com" has no placeholder, use %s, {1} or {param}`,
+		},
+		{
+			desc:        "Placeholder zero",
+			url:         namedURL{URL: "https://github.com/{0}", Kind: "template"},
+			expectError: `Not a valid placeholder in "https://github.com/{0}": {0}, arguments start at {1}`,
+		},
+		{
+			desc:        "Mixed placeholders",
+			url:         namedURL{URL: "https://github.com/%s/{2}", Kind: "template"},
+			expectError: `The template "https://github.com/%s/{2}" mixes %s and {n} placeholders`,
+		},
+		{
+			desc:        "Fallback with placeholders",
+			url:         namedURL{URL: "https://github.com/%s", Kind: "template", FallbackURL: "https://github.com/%s"},
+			expectError: `The fallback URL "https://github.com/%s" cannot have placeholders`,
+		},
+		{
+			desc:        "Template expanding dates",
+			url:         namedURL{URL: "https://github.com/%s", Kind: "template", ShouldExpandDates: true},
+			expectError: "Template links cannot expand dates",
+		},
+	}
+
+	for _, test := range tests {
+		err := validateKind(test.url)
+		if test.expectError == "" {
+			if err != nil {
+				t.Errorf("%s: validateKind(...) failed: %v", test.desc, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.expectError {
+			t.Errorf("%s: validateKind(...) returned %v, want %q", test.desc, err, test.expectError)
+		}
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	tests := []struct {
+		desc       string
+		template   string
+		args       []string
+		params     neturl.Values
+		expect     string
+		expectUsed []string
+		expectOK   bool
+	}{
+		{
+			desc:     "Next placeholder",
+			template: "https://jira.example.com/browse/%s",
+			args:     []string{"PROJ-123"},
+			expect:   "https://jira.example.com/browse/PROJ-123",
+			expectOK: true,
+		},
+		{
+			desc:     "Indexed placeholders in any order",
+			template: "https://github.com/{2}/{1}",
+			args:     []string{"url-shortener", "pcorpet"},
+			expect:   "https://github.com/pcorpet/url-shortener",
+			expectOK: true,
+		},
+		{
+			desc:     "Escaped in path and query",
+			template: "https://example.com/%s?q=%s",
+			args:     []string{"a b", "c&d"},
+			expect:   "https://example.com/a%20b?q=c%26d",
+			expectOK: true,
+		},
+		{
+			desc:     "Extra arguments are ignored",
+			template: "https://jira.example.com/browse/%s",
+			args:     []string{"PROJ-123", "comments"},
+			expect:   "https://jira.example.com/browse/PROJ-123",
+			expectOK: true,
+		},
+		{
+			desc:     "Missing argument",
+			template: "https://github.com/{1}/{2}",
+			args:     []string{"pcorpet"},
+			expect:   "https://github.com/pcorpet/",
+		},
+		{
+			desc:       "Named placeholders",
+			template:   "https://search.example.com/?q={q}&team={team}",
+			params:     neturl.Values{"q": {"bug 42"}, "team": {"web"}},
+			expect:     "https://search.example.com/?q=bug+42&team=web",
+			expectUsed: []string{"q", "team"},
+			expectOK:   true,
+		},
+		{
+			desc:       "Default value",
+			template:   "https://search.example.com/?q={q}&team={team=platform}",
+			params:     neturl.Values{"q": {"bug"}},
+			expect:     "https://search.example.com/?q=bug&team=platform",
+			expectUsed: []string{"q", "team"},
+			expectOK:   true,
+		},
+		{
+			desc:       "Override default value",
+			template:   "https://search.example.com/?q={q}&team={team=platform}",
+			params:     neturl.Values{"q": {"bug"}, "team": {"web"}},
+			expect:     "https://search.example.com/?q=bug&team=web",
+			expectUsed: []string{"q", "team"},
+			expectOK:   true,
+		},
+		{
+			desc:       "Empty parameter uses default value",
+			template:   "https://search.example.com/?q={q}&team={team=platform}",
+			params:     neturl.Values{"q": {"bug"}, "team": {""}},
+			expect:     "https://search.example.com/?q=bug&team=platform",
+			expectUsed: []string{"q", "team"},
+			expectOK:   true,
+		},
+		{
+			desc:       "Empty default value",
+			template:   "https://search.example.com/?q={q=}",
+			expect:     "https://search.example.com/?q=",
+			expectUsed: []string{"q"},
+			expectOK:   true,
+		},
+		{
+			desc:     "Default argument",
+			template: "https://github.com/pcorpet/{1}/tree/{2=main}",
+			args:     []string{"url-shortener"},
+			expect:   "https://github.com/pcorpet/url-shortener/tree/main",
+			expectOK: true,
+		},
+		{
+			desc:       "Path argument and named parameter",
+			template:   "https://jira.example.com/browse/%s?focusedCommentId={comment}",
+			args:       []string{"PROJ-123"},
+			params:     neturl.Values{"comment": {"7"}},
+			expect:     "https://jira.example.com/browse/PROJ-123?focusedCommentId=7",
+			expectUsed: []string{"comment"},
+			expectOK:   true,
+		},
+		{
+			desc:       "Missing parameter",
+			template:   "https://search.example.com/?q={q}",
+			expect:     "https://search.example.com/?q=",
+			expectUsed: []string{"q"},
+		},
+	}
+
+	for _, test := range tests {
+		got, used, ok := expandTemplate(test.template, test.args, test.params)
+		if got != test.expect || ok != test.expectOK {
+			t.Errorf("%s: expandTemplate(%q, %q, %v) returned %q, %t, want %q, %t", test.desc, test.template, test.args, test.params, got, ok, test.expect, test.expectOK)
+		}
+		if !reflect.DeepEqual(used, test.expectUsed) {
+			t.Errorf("%s: expandTemplate(...) used the parameters %q, want %q", test.desc, used, test.expectUsed)
+		}
+	}
+}
+
+func TestMergeQuery(t *testing.T) {
+	tests := []struct {
+		desc   string
+		url    string
+		params neturl.Values
+		expect string
+	}{
+		{
+			desc:   "No parameters",
+			url:    "https://example.com/?b=2&a=1",
+			expect: "https://example.com/?b=2&a=1",
+		},
+		{
+			desc:   "Added to a URL without query",
+			url:    "https://example.com/",
+			params: neturl.Values{"tab": {"readme"}},
+			expect: "https://example.com/?tab=readme",
+		},
+		{
+			desc:   "Appended to the query of the URL",
+			url:    "https://example.com/?b=2&a=1",
+			params: neturl.Values{"tab": {"readme"}},
+			expect: "https://example.com/?b=2&a=1&tab=readme",
+		},
+		{
+			desc:   "The query of the URL wins",
+			url:    "https://example.com/?tab=code",
+			params: neturl.Values{"tab": {"readme"}, "lang": {"go"}},
+			expect: "https://example.com/?tab=code&lang=go",
+		},
+	}
+
+	for _, test := range tests {
+		if got := mergeQuery(test.url, test.params); got != test.expect {
+			t.Errorf("%s: mergeQuery(%q, %v) returned %q, want %q", test.desc, test.url, test.params, got, test.expect)
+		}
+	}
+}
+
+func TestTemplateLinks(t *testing.T) {
+	db := &memoryDatabase{}
+	var hits recordedHits
+	s := &server{DB: db, Clock: realClock{}, Analytics: &hits}
+	r := mux.NewRouter()
+	r.HandleFunc("/_/save", s.Save).Methods("POST")
+	r.Handle("/{name}{folder:(?:/.*)?}", http.HandlerFunc(s.Load))
+	if response := serveRequest(r, "POST", "/_/save", `{"name":"jira","url":"https://jira.example.com/browse/%s","kind":"template"}`, nil); response.Code != http.StatusOK {
+		t.Fatalf("Saving a template had response code %d, want %d\n%v", response.Code, http.StatusOK, response)
+	}
+	if response := serveRequest(r, "POST", "/_/save", `{"name":"gh","url":"https://github.com/{1}/{2}","kind":"template","fallbackUrl":"https://github.com"}`, nil); response.Code != http.StatusOK {
+		t.Fatalf("Saving a template had response code %d, want %d\n%v", response.Code, http.StatusOK, response)
+	}
+	if response := serveRequest(r, "POST", "/_/save", `{"name":"search","url":"https://search.example.com/?q={q}&team={team=platform}&lang=en","kind":"template"}`, nil); response.Code != http.StatusOK {
+		t.Fatalf("Saving a template had response code %d, want %d\n%v", response.Code, http.StatusOK, response)
+	}
+	if response := serveRequest(r, "POST", "/_/save", `{"name":"bad","url":"https://example.com","kind":"template"}`, nil); response.Code != http.StatusBadRequest {
+		t.Errorf("Saving a template without placeholders had response code %d, want %d", response.Code, http.StatusBadRequest)
+	}
+	if _, err := db.LoadURL(context.Background(), "bad"); err == nil {
+		t.Errorf("An invalid template was saved")
+	}
+
+	tests := []struct {
+		desc           string
+		request        string
+		expectRedirect string
+		// expectMissing is whether arguments are missing, so that no hit is
+		// recorded.
+		expectMissing bool
+	}{
+		{
+			desc:           "Next placeholder",
+			request:        "/jira/PROJ-123",
+			expectRedirect: "https://jira.example.com/browse/PROJ-123",
+		},
+		{
+			desc:           "Escaped slash in an argument",
+			request:        "/jira/PROJ%2F123",
+			expectRedirect: "https://jira.example.com/browse/PROJ%2F123",
+		},
+		{
+			desc:           "Indexed placeholders and query string",
+			request:        "/gh/pcorpet/url-shortener?tab=readme",
+			expectRedirect: "https://github.com/pcorpet/url-shortener?tab=readme",
+		},
+		{
+			desc:           "Fallback",
+			request:        "/gh/pcorpet",
+			expectRedirect: "https://github.com",
+			expectMissing:  true,
+		},
+		{
+			desc:           "Missing argument without fallback",
+			request:        "/jira",
+			expectRedirect: "/#/?error=Missing+arguments+for+%22jira%22%3A+https%3A%2F%2Fjira.example.com%2Fbrowse%2F%25s",
+			expectMissing:  true,
+		},
+		{
+			desc:           "Named parameters with default",
+			request:        "/search?q=flaky+test",
+			expectRedirect: "https://search.example.com/?q=flaky+test&team=platform&lang=en",
+		},
+		{
+			desc:           "Named parameters override the default",
+			request:        "/search?q=bug&team=web",
+			expectRedirect: "https://search.example.com/?q=bug&team=web&lang=en",
+		},
+		{
+			desc:           "Other parameters are merged but do not override the target",
+			request:        "/search?q=bug&lang=fr&page=2",
+			expectRedirect: "https://search.example.com/?q=bug&team=platform&lang=en&page=2",
+		},
+		{
+			desc:           "Path arguments and extra parameters",
+			request:        "/jira/PROJ-123?focusedCommentId=7",
+			expectRedirect: "https://jira.example.com/browse/PROJ-123?focusedCommentId=7",
+		},
+	}
+	for _, test := range tests {
+		hitsBefore := len(hits)
+		response := serveRequest(r, "GET", test.request, "", nil)
+		if got, want := response.Code, http.StatusFound; got != want {
+			t.Errorf("%s: s.Load(...) had response code %d, want %d", test.desc, got, want)
+		}
+		if got := response.Header().Get("Location"); got != test.expectRedirect {
+			t.Errorf("%s: s.Load(...) redirected to %q, want %q", test.desc, got, test.expectRedirect)
+		}
+		wantHits := 1
+		if test.expectMissing {
+			wantHits = 0
+		}
+		if got := len(hits) - hitsBefore; got != wantHits {
+			t.Errorf("%s: s.Load(...) recorded %d hits, want %d", test.desc, got, wantHits)
+		}
+	}
+}
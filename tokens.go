@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// An apiToken lets scripts act on behalf of a user without going through the
+// browser login.
+type apiToken struct {
+	// ID identifies the token to revoke it. It is not a secret.
+	ID string `json:"id" bson:"id"`
+	// Hash is the SHA-256 of the token: the token itself is never stored.
+	Hash string `json:"-" bson:"_id"`
+	// User is the user on behalf of whom the token acts.
+	User string `json:"user" bson:"user"`
+	// Name is a free text to remember what the token is used for.
+	Name string `json:"name" bson:"name"`
+	// Created is when the token was created.
+	Created time.Time `json:"created" bson:"created"`
+}
+
+// A tokenStore persists the API tokens.
+type tokenStore interface {
+	// SaveToken saves a new token.
+	SaveToken(ctx context.Context, t apiToken) error
+
+	// LoadToken loads a token by its hash. It returns a TokenNotFoundError if
+	// there is none.
+	LoadToken(ctx context.Context, hash string) (apiToken, error)
+
+	// ListTokens lists the tokens of a user, oldest first.
+	ListTokens(ctx context.Context, user string) ([]apiToken, error)
+
+	// DeleteToken deletes a token by its ID only if it belongs to the given
+	// user. It returns a TokenNotFoundError otherwise.
+	DeleteToken(ctx context.Context, id string, user string) error
+}
+
+// A TokenNotFoundError is triggered if an API token does not exist.
+type TokenNotFoundError struct{}
+
+func (e TokenNotFoundError) Error() string {
+	return "no such API token"
+}
+
+// hashToken returns the hash under which a token is stored.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomString returns a random URL safe string made from n random bytes.
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// sortTokens sorts tokens from the oldest.
+func sortTokens(tokens []apiToken) {
+	sort.Slice(tokens, func(i, j int) bool {
+		if !tokens[i].Created.Equal(tokens[j].Created) {
+			return tokens[i].Created.Before(tokens[j].Created)
+		}
+		return tokens[i].ID < tokens[j].ID
+	})
+}
+
+// CreateToken creates an API token for the user. The token is only returned
+// in this response, it cannot be retrieved afterwards. Requests made with an
+// API token cannot create tokens, so that a leaked token cannot outlive its
+// revocation.
+func (s server) CreateToken(response http.ResponseWriter, request *http.Request) {
+	if s.Tokens == nil {
+		http.Error(response, `{"error":"API tokens are not supported by this storage"}`, http.StatusNotFound)
+		return
+	}
+	user := userFrom(request)
+	if user == "" {
+		http.Error(response, `{"error":"Request with no user"}`, http.StatusUnauthorized)
+		return
+	}
+	if isTokenAuthenticated(request) {
+		http.Error(response, `{"error":"API tokens cannot create other tokens"}`, http.StatusForbidden)
+		return
+	}
+
+	decoder := json.NewDecoder(request.Body)
+	var data struct {
+		Name string `json:"name"`
+	}
+	if err := decoder.Decode(&data); err != nil {
+		http.Error(response, `{"error":"Unable to parse json"}`, http.StatusBadRequest)
+		return
+	}
+
+	token, err := randomString(32)
+	if err != nil {
+		http.Error(response, `{"error":"Could not generate a token"}`, http.StatusInternalServerError)
+		return
+	}
+	id, err := randomString(9)
+	if err != nil {
+		http.Error(response, `{"error":"Could not generate a token"}`, http.StatusInternalServerError)
+		return
+	}
+	t := apiToken{
+		ID:      id,
+		Hash:    hashToken(token),
+		User:    user,
+		Name:    data.Name,
+		Created: s.Clock.Now(),
+	}
+	if err := s.Tokens.SaveToken(request.Context(), t); err != nil {
+		writeDBError(response, err)
+		return
+	}
+
+	reply := struct {
+		apiToken
+		Token string `json:"token"`
+	}{t, token}
+	if jsonData, ok := marshalJson(response, reply); ok {
+		response.Write(jsonData)
+	}
+}
+
+// ListTokens lists the API tokens of the user, without the tokens themselves.
+func (s server) ListTokens(response http.ResponseWriter, request *http.Request) {
+	if s.Tokens == nil {
+		http.Error(response, `{"error":"API tokens are not supported by this storage"}`, http.StatusNotFound)
+		return
+	}
+	user := userFrom(request)
+	if user == "" {
+		http.Error(response, `{"error":"Request with no user"}`, http.StatusUnauthorized)
+		return
+	}
+
+	tokens, err := s.Tokens.ListTokens(request.Context(), user)
+	if err != nil {
+		writeDBError(response, err)
+		return
+	}
+	if len(tokens) == 0 {
+		tokens = []apiToken{}
+	}
+
+	if jsonData, ok := marshalJson(response, map[string]interface{}{"tokens": tokens}); ok {
+		response.Write(jsonData)
+	}
+}
+
+// RevokeToken deletes one of the API tokens of the user.
+func (s server) RevokeToken(response http.ResponseWriter, request *http.Request) {
+	if s.Tokens == nil {
+		http.Error(response, `{"error":"API tokens are not supported by this storage"}`, http.StatusNotFound)
+		return
+	}
+	user := userFrom(request)
+	if user == "" {
+		http.Error(response, `{"error":"Request with no user"}`, http.StatusUnauthorized)
+		return
+	}
+
+	if err := s.Tokens.DeleteToken(request.Context(), mux.Vars(request)["id"], user); err != nil {
+		if _, ok := err.(TokenNotFoundError); ok {
+			http.Error(response, `{"error":"No such token"}`, http.StatusNotFound)
+			return
+		}
+		writeDBError(response, err)
+		return
+	}
+
+	response.Write([]byte(`{"success":true}`))
+}
+
+type tokenAuthKey struct{}
+
+// isTokenAuthenticated returns whether the request was authenticated with an
+// API token rather than by a login.
+func isTokenAuthenticated(request *http.Request) bool {
+	authenticated, _ := request.Context().Value(tokenAuthKey{}).(bool)
+	return authenticated
+}
+
+// authenticateTokens wraps a handler so that requests with an API token in an
+// "Authorization: Bearer" header are made on behalf of the token's user.
+// Requests with an unknown token are rejected.
+func (s server) authenticateTokens(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		authorization := request.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, "Bearer ") {
+			next.ServeHTTP(response, request)
+			return
+		}
+
+		token := strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+		t, err := s.Tokens.LoadToken(request.Context(), hashToken(token))
+		if err != nil {
+			if _, ok := err.(TokenNotFoundError); ok {
+				http.Error(response, `{"error":"Invalid API token"}`, http.StatusUnauthorized)
+				return
+			}
+			writeDBError(response, err)
+			return
+		}
+		request.Header.Del("X-Forwarded-User")
+		request.Header.Del(forwardedGroupsHeader)
+		ctx := context.WithValue(withUser(request.Context(), t.User), tokenAuthKey{}, true)
+		next.ServeHTTP(response, request.WithContext(ctx))
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestTokens(t *testing.T) {
+	db := &memoryDatabase{}
+	s := &server{
+		Clock:  fakeClock{time.Date(2020, 9, 3, 10, 0, 0, 0, time.UTC)},
+		DB:     db,
+		Tokens: db,
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/_/tokens", s.ListTokens).Methods("GET")
+	r.HandleFunc("/_/tokens", s.CreateToken).Methods("POST")
+	r.HandleFunc("/_/tokens/{id}", s.RevokeToken).Methods("DELETE")
+	r.HandleFunc("/_/save", s.Save).Methods("POST")
+	r.HandleFunc("/_/list", s.List).Methods("POST")
+	handler := s.authenticateTokens(r)
+
+	pascal := map[string]string{"X-Forwarded-User": "pascal"}
+
+	if response := serveRequest(handler, "POST", "/_/tokens", `{"name":"CI"}`, nil); response.Code != http.StatusUnauthorized {
+		t.Errorf("Creating a token without user had response code %d, want %d", response.Code, http.StatusUnauthorized)
+	}
+
+	response := serveRequest(handler, "POST", "/_/tokens", `{"name":"CI"}`, pascal)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Creating a token had response code %d, want %d\n%v", response.Code, http.StatusOK, response)
+	}
+	var created struct {
+		ID    string `json:"id"`
+		Token string `json:"token"`
+		Hash  string `json:"hash"`
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &created); err != nil || created.ID == "" || created.Token == "" {
+		t.Fatalf("Creating a token returned %q", response.Body.String())
+	}
+	if created.Hash != "" {
+		t.Errorf("Creating a token returned its hash: %q", response.Body.String())
+	}
+
+	response = serveRequest(handler, "GET", "/_/tokens", "", pascal)
+	if got := response.Body.String(); !strings.Contains(got, `"id":"`+created.ID+`"`) || strings.Contains(got, created.Token) {
+		t.Errorf("Listing tokens returned %q, want the token ID without the token itself", got)
+	}
+
+	// A script uses the token to save a link.
+	bearer := map[string]string{"Authorization": "Bearer " + created.Token}
+	response = serveRequest(handler, "POST", "/_/save", `{"name":"release-notes","url":"http://example.com/notes"}`, bearer)
+	if response.Code != http.StatusOK {
+		t.Errorf("Saving with a token had response code %d, want %d\n%v", response.Code, http.StatusOK, response)
+	}
+	if u, err := db.LoadURL(context.Background(), "release-notes"); err != nil || !isOwner(u, "pascal") {
+		t.Errorf("The link saved with a token is %#v, %v, want it owned by pascal", u, err)
+	}
+	response = serveRequest(handler, "POST", "/_/list", "", map[string]string{
+		"Authorization":    "Bearer " + created.Token,
+		"X-Forwarded-User": "SUPER USER",
+	})
+	if got := response.Body.String(); !strings.Contains(got, `"user":"pascal"`) {
+		t.Errorf("Listing with a token returned %q, want the user of the token", got)
+	}
+
+	if response := serveRequest(handler, "POST", "/_/tokens", `{"name":"CI"}`, bearer); response.Code != http.StatusForbidden {
+		t.Errorf("Creating a token with a token had response code %d, want %d", response.Code, http.StatusForbidden)
+	}
+
+	if response := serveRequest(handler, "POST", "/_/list", "", map[string]string{"Authorization": "Bearer forged"}); response.Code != http.StatusUnauthorized {
+		t.Errorf("Listing with a wrong token had response code %d, want %d", response.Code, http.StatusUnauthorized)
+	}
+
+	if response := serveRequest(handler, "DELETE", "/_/tokens/"+created.ID, "", map[string]string{"X-Forwarded-User": "john"}); response.Code != http.StatusNotFound {
+		t.Errorf("Revoking the token of another user had response code %d, want %d", response.Code, http.StatusNotFound)
+	}
+	if response := serveRequest(handler, "DELETE", "/_/tokens/"+created.ID, "", pascal); response.Code != http.StatusOK {
+		t.Errorf("Revoking a token had response code %d, want %d", response.Code, http.StatusOK)
+	}
+	if response := serveRequest(handler, "POST", "/_/list", "", bearer); response.Code != http.StatusUnauthorized {
+		t.Errorf("Listing with a revoked token had response code %d, want %d", response.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// The visibilities of a short URL. Links are public unless told otherwise.
+const (
+	// visibilityPublic links are listed and redirect for everyone.
+	visibilityPublic = "public"
+	// visibilityUnlisted links redirect for everyone but are only listed and
+	// searched for their owners.
+	visibilityUnlisted = "unlisted"
+	// visibilityPrivate links are unlisted and only redirect for their owners
+	// and the users or groups they allow.
+	visibilityPrivate = "private"
+)
+
+// isValidVisibility returns whether a visibility is known, the empty one
+// meaning public.
+func isValidVisibility(visibility string) bool {
+	switch visibility {
+	case "", visibilityPublic, visibilityUnlisted, visibilityPrivate:
+		return true
+	}
+	return false
+}
+
+// isListedFor returns whether a URL shows up in lists and searches for a
+// viewer, as returned by server.viewer.
+func isListedFor(u namedURL, viewer []string) bool {
+	return u.Visibility == "" || u.Visibility == visibilityPublic || isOwnedBy(u, viewer)
+}
+
+// canFollow returns whether a viewer, as returned by server.viewer, may be
+// redirected by a URL.
+func canFollow(u namedURL, viewer []string) bool {
+	if u.Visibility != visibilityPrivate || isOwnedBy(u, viewer) {
+		return true
+	}
+	for _, principal := range viewer {
+		for _, allowed := range u.Allowed {
+			if principal == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// canFollowName returns whether a viewer, as returned by server.viewer, may
+// be redirected by the URL with the given name. Once a URL is deleted, its
+// last version in the history is checked instead so that the details of a
+// private URL do not leak.
+func (s server) canFollowName(ctx context.Context, name string, viewer []string) (bool, error) {
+	current, err := s.DB.LoadURL(ctx, name)
+	if err == nil {
+		return canFollow(current, viewer), nil
+	}
+	if _, ok := err.(NotFoundError); !ok {
+		return false, err
+	}
+
+	revs, err := s.DB.ListRevisions(ctx, name)
+	if err != nil || len(revs) == 0 {
+		return true, err
+	}
+	last := revs[len(revs)-1]
+	if last.After != nil {
+		return canFollow(*last.After, viewer), nil
+	}
+	if last.Before != nil {
+		return canFollow(*last.Before, viewer), nil
+	}
+	return true, nil
+}
+
+// listedFor keeps the URLs that are listed for a viewer at the given time.
+// Expired URLs are only listed for super users, so that they can claim them.
+func listedFor(urls []namedURL, viewer []string, now time.Time) []namedURL {
+	listed := []namedURL{}
+	for _, u := range urls {
+		if viewer != nil && isExpired(u, now) {
+			continue
+		}
+		if isListedFor(u, viewer) {
+			listed = append(listed, u)
+		}
+	}
+	return listed
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestVisibility(t *testing.T) {
+	db := &memoryDatabase{}
+	for _, u := range []namedURL{
+		{Name: "handbook", URL: "http://example.com/handbook", Description: "team docs"},
+		{Name: "offsite", URL: "http://example.com/offsite", Owners: []string{"lascap"}, Visibility: visibilityUnlisted, Description: "team docs"},
+		{Name: "salaries", URL: "http://example.com/salaries", Owners: []string{"lascap"}, Visibility: visibilityPrivate, Allowed: []string{"group:hr"}, Description: "team docs"},
+	} {
+		if err := db.SaveURL(context.Background(), u); err != nil {
+			t.Fatalf("SaveURL failed: %v", err)
+		}
+	}
+	s := &server{
+		DB:        db,
+		Clock:     fakeClock{time.Date(2020, 9, 3, 10, 0, 0, 0, time.UTC)},
+		SuperUser: map[string]bool{"SUPER USER": true},
+		Groups:    headerGroups{},
+		Stats:     db,
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/_/list", s.List).Methods("POST")
+	r.HandleFunc("/_/search", s.Search).Methods("GET")
+	r.HandleFunc("/_/{name}/stats", s.LinkStats).Methods("GET")
+	r.HandleFunc("/{name}", s.Load)
+
+	tests := []struct {
+		desc            string
+		forwardedUser   string
+		forwardedGroups string
+		expectListed    []string
+		// expectFirstFound is the best listed match when searching "o".
+		expectFirstFound string
+		expectFollowed   []string
+	}{
+		{
+			desc:             "Anonymous",
+			expectListed:     []string{"handbook"},
+			expectFirstFound: "handbook",
+			expectFollowed:   []string{"handbook", "offsite"},
+		},
+		{
+			desc:             "Other user",
+			forwardedUser:    "john",
+			expectListed:     []string{"handbook"},
+			expectFirstFound: "handbook",
+			expectFollowed:   []string{"handbook", "offsite"},
+		},
+		{
+			desc:             "Member of an allowed group",
+			forwardedUser:    "john",
+			forwardedGroups:  "hr",
+			expectListed:     []string{"handbook"},
+			expectFirstFound: "handbook",
+			expectFollowed:   []string{"handbook", "offsite", "salaries"},
+		},
+		{
+			desc:             "Owner",
+			forwardedUser:    "lascap",
+			expectListed:     []string{"handbook", "offsite", "salaries"},
+			expectFirstFound: "offsite",
+			expectFollowed:   []string{"handbook", "offsite", "salaries"},
+		},
+		{
+			desc:             "Super user",
+			forwardedUser:    "SUPER USER",
+			expectListed:     []string{"handbook", "offsite", "salaries"},
+			expectFirstFound: "offsite",
+			expectFollowed:   []string{"handbook", "offsite", "salaries"},
+		},
+	}
+
+	for _, test := range tests {
+		headers := map[string]string{
+			"X-Forwarded-User":   test.forwardedUser,
+			"X-Forwarded-Groups": test.forwardedGroups,
+		}
+		names := func(response *httptest.ResponseRecorder) []string {
+			var data struct {
+				URLs []namedURL `json:"urls"`
+			}
+			if err := json.Unmarshal(response.Body.Bytes(), &data); err != nil {
+				t.Errorf("%s: could not parse %q: %v", test.desc, response.Body.String(), err)
+			}
+			names := []string{}
+			for _, u := range data.URLs {
+				names = append(names, u.Name)
+			}
+			return names
+		}
+
+		if got := names(serveRequest(r, "POST", "/_/list", "", headers)); !reflect.DeepEqual(got, test.expectListed) {
+			t.Errorf("%s: s.List(...) returned %q, want %q", test.desc, got, test.expectListed)
+		}
+		if got := names(serveRequest(r, "GET", "/_/search?q=docs", "", headers)); !reflect.DeepEqual(got, test.expectListed) {
+			t.Errorf("%s: s.Search(...) returned %q, want %q", test.desc, got, test.expectListed)
+		}
+		if got := names(serveRequest(r, "GET", "/_/search?q=o&limit=1", "", headers)); !reflect.DeepEqual(got, []string{test.expectFirstFound}) {
+			t.Errorf("%s: s.Search(...) with a limit returned %q, want %q", test.desc, got, test.expectFirstFound)
+		}
+
+		followed := []string{}
+		for _, name := range []string{"handbook", "offsite", "salaries"} {
+			response := serveRequest(r, "GET", "/"+name, "", headers)
+			if response.Code == http.StatusMovedPermanently {
+				followed = append(followed, name)
+			} else if location := response.Header().Get("Location"); strings.Contains(location, "suggestion=salaries") {
+				t.Errorf("%s: s.Load(...) revealed the private link in %q", test.desc, location)
+			}
+		}
+		if !reflect.DeepEqual(followed, test.expectFollowed) {
+			t.Errorf("%s: s.Load(...) redirected for %q, want %q", test.desc, followed, test.expectFollowed)
+		}
+
+		wantDetails := http.StatusNotFound
+		if test.expectFollowed[len(test.expectFollowed)-1] == "salaries" {
+			wantDetails = http.StatusOK
+		}
+		if got := serveRequest(r, "GET", "/_/salaries/stats", "", headers).Code; got != wantDetails {
+			t.Errorf("%s: s.LinkStats(...) of the private link had response code %d, want %d", test.desc, got, wantDetails)
+		}
+	}
+}
+
+func TestHistoryOfDeletedPrivateLink(t *testing.T) {
+	s := &server{DB: &memoryDatabase{}, Clock: realClock{}}
+	r := mux.NewRouter()
+	r.HandleFunc("/_/save", s.Save).Methods("POST")
+	r.HandleFunc("/_/{name}/history", s.History).Methods("GET")
+	r.HandleFunc("/_/{name}", s.Delete).Methods("DELETE")
+	if response := serveAs(r, "POST", "/_/save", `{"name":"salaries","url":"http://example.com/salaries","visibility":"private"}`, "lascap"); response.Code != http.StatusOK {
+		t.Fatalf("Saving a private link had response code %d, want %d\n%v", response.Code, http.StatusOK, response)
+	}
+	if response := serveAs(r, "DELETE", "/_/salaries", "", "lascap"); response.Code != http.StatusOK {
+		t.Fatalf("Deleting a private link had response code %d, want %d\n%v", response.Code, http.StatusOK, response)
+	}
+
+	if got := serveAs(r, "GET", "/_/salaries/history", "", "").Code; got != http.StatusNotFound {
+		t.Errorf("The history of a deleted private link had response code %d for an anonymous user, want %d", got, http.StatusNotFound)
+	}
+	if got := serveAs(r, "GET", "/_/salaries/history", "", "lascap").Code; got != http.StatusOK {
+		t.Errorf("The history of a deleted private link had response code %d for its owner, want %d", got, http.StatusOK)
+	}
+}
+
+func TestUpdateKeepsVisibility(t *testing.T) {
+	db := &memoryDatabase{}
+	if err := db.SaveURL(context.Background(), namedURL{Name: "salaries", URL: "http://example.com/salaries", Owners: []string{"lascap"}, Visibility: visibilityPrivate, Allowed: []string{"group:hr"}}); err != nil {
+		t.Fatalf("SaveURL failed: %v", err)
+	}
+	s := &server{DB: db, Clock: realClock{}}
+	r := mux.NewRouter()
+	r.HandleFunc("/_/{name}", s.Update).Methods("PUT")
+	r.HandleFunc("/{name}", s.Load)
+
+	// A script only updates the target.
+	if response := serveAs(r, "PUT", "/_/salaries", `{"url":"http://example.com/salaries-2020"}`, "lascap"); response.Code != http.StatusOK {
+		t.Fatalf("Updating a private link had response code %d, want %d\n%v", response.Code, http.StatusOK, response)
+	}
+	u, err := db.LoadURL(context.Background(), "salaries")
+	if err != nil || u.URL != "http://example.com/salaries-2020" || u.Visibility != visibilityPrivate || !reflect.DeepEqual(u.Allowed, []string{"group:hr"}) {
+		t.Errorf("Updating the target of a private link stored %#v, %v, want it to stay private", u, err)
+	}
+	if response := serveAs(r, "GET", "/salaries", "", ""); response.Code == http.StatusMovedPermanently {
+		t.Errorf("An anonymous user was redirected by the updated private link to %q", response.Header().Get("Location"))
+	}
+
+	if response := serveAs(r, "PUT", "/_/salaries", `{"url":"http://example.com/salaries-2020","visibility":"public","allowed":[]}`, "lascap"); response.Code != http.StatusOK {
+		t.Fatalf("Making a private link public had response code %d, want %d\n%v", response.Code, http.StatusOK, response)
+	}
+	if u, err := db.LoadURL(context.Background(), "salaries"); err != nil || u.Visibility != "" || len(u.Allowed) != 0 {
+		t.Errorf("Making a private link public stored %#v, %v", u, err)
+	}
+}
+
+func TestSaveInvalidVisibility(t *testing.T) {
+	s := &server{DB: &memoryDatabase{}, Clock: realClock{}}
+	response := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "http://go/_/save", strings.NewReader(`{"name":"wiki","url":"http://en.wikipedia.org","visibility":"secret"}`))
+	s.Save(response, request)
+	if got, want := response.Body.String(), `{"error":"Not a valid visibility: \"secret\""}`+"\n"; got != want {
+		t.Errorf("s.Save(...) with an invalid visibility returned %q, want %q", got, want)
+	}
+}